@@ -1,31 +1,80 @@
 package pkg
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
 )
 
+// Metadata value的正排信息, 用于逐个过滤候选value
 type Metadata struct {
+	// 每个属性上的key, 一个value在同一个属性上可以有多个key, 为nil表示该属性通配
+	attrs map[string][][]byte
+	// negated 该属性上的key是排除集合, 匹配key之外的取值
+	negated map[string]bool
+	// ternary 每个属性上的三态key, 与attrs中的前缀为或的关系
+	ternary map[string][][]byte
+
+	// 优先级, 数值越小优先级越高
+	priority int
 }
 
 type attrItem struct {
 	byteLen uint32
 	tag     uint32
-	trie    *trie.PTrie
+	// trie 维护子树聚合信息, 查询计划和规则分析按聚合值估算数量; notTrie 和 ternaryTrie 不需要
+	trie *trie.PTrie
+
+	// str 字符串属性, key为变长的字符串, byteLen 为0; fold 索引和查询时统一转换为小写
+	str  bool
+	fold bool
+	// ids 字符串到编号的映射, 用于在规则分析中把字符串当作单点区间;
+	// 字符串不再被任何value使用时删除, nextID 保证编号不被复用
+	ids    map[string]uint64
+	nextID uint64
+	// timed 时间属性, key为 EncodeTime 的编码
+	timed bool
+
+	// 该属性通配的value, 满足该属性上的任意谓词
+	any *vpack.VPack
+
+	// 取反约束的排除集合存储在notTrie中, not 为该属性上带取反约束的所有value
+	notTrie *trie.PTrie
+	not     *vpack.VPack
+
+	// 三态约束存储在ternaryTrie中, ternaryValues 为该属性上带三态约束的所有value
+	ternaryTrie   *trie.PTrie
+	ternaryValues *vpack.VPack
+
+	// 查询计划使用的统计信息, 为nil表示尚未收集或已过期, 写入和删除时置为nil
+	stats *AttrStats
 }
 
 type Indexer struct {
 	attrItems map[string]*attrItem
 
 	metadataTable map[int64]*Metadata
+
+	// 所有已索引的value, 用于求补集
+	all *vpack.VPack
+
+	// priorities 优先级不为0的value按优先级分组, prioritized 为这些value的并集,
+	// TopK 按优先级逐组求交集, 不需要逐个查找value的优先级
+	priorities  map[int]*vpack.VPack
+	prioritized *vpack.VPack
 }
 
 func newIndexer() *Indexer {
 	return &Indexer{
 		attrItems:     make(map[string]*attrItem),
 		metadataTable: make(map[int64]*Metadata),
+		all:           vpack.NewValuePack(0, 0),
+		priorities:    make(map[int]*vpack.VPack),
+		prioritized:   vpack.NewValuePack(0, 0),
 	}
 }
 
@@ -50,7 +99,7 @@ func (b *builder) Build() (*Indexer, error) {
 			return nil, fmt.Errorf("attribute %s trie is nil", attrName)
 		}
 
-		if isIllegalLen(item.byteLen) {
+		if !item.str && isIllegalLen(item.byteLen) {
 			return nil, fmt.Errorf("attribut %s bytelen(%d) is illegal", attrName, item.byteLen)
 		}
 	}
@@ -73,9 +122,14 @@ func (b *builder) AddAttrItem(attr string, byteLen uint32, tag uint32) *builder
 	}
 
 	attrItem := &attrItem{
-		byteLen: byteLen,
-		tag:     tag,
-		trie:    trie.NewTrie(),
+		byteLen:       byteLen,
+		tag:           tag,
+		trie:          trie.NewTrieWithAggregates(),
+		any:           vpack.NewValuePack(tag, 0),
+		notTrie:       trie.NewTrie(),
+		not:           vpack.NewValuePack(tag, 0),
+		ternaryTrie:   trie.NewTrie(),
+		ternaryValues: vpack.NewValuePack(tag, 0),
 	}
 
 	indexer.attrItems[attr] = attrItem
@@ -83,12 +137,36 @@ func (b *builder) AddAttrItem(attr string, byteLen uint32, tag uint32) *builder
 	return b
 }
 
+// AddStringAttrItem 添加字符串属性, foldCase 为true时不区分大小写
+func (b *builder) AddStringAttrItem(attr string, tag uint32, foldCase bool) *builder {
+	indexer := b.indexer
+	if _, ok := indexer.attrItems[attr]; ok {
+		return b
+	}
+
+	indexer.attrItems[attr] = &attrItem{
+		tag:           tag,
+		trie:          trie.NewTrieWithAggregates(),
+		any:           vpack.NewValuePack(tag, 0),
+		notTrie:       trie.NewTrie(),
+		not:           vpack.NewValuePack(tag, 0),
+		ternaryTrie:   trie.NewTrie(),
+		ternaryValues: vpack.NewValuePack(tag, 0),
+		str:           true,
+		fold:          foldCase,
+		ids:           make(map[string]uint64),
+	}
+
+	return b
+}
+
+// IntXXToBytes 按大端序编码为 intLen/8 个字节, 保证字节序与数值大小一致
 func IntXXToBytes(v int64, intLen uint32) []byte {
-	l := int(intLen / 4)
+	l := int(intLen / 8)
 
 	var buf = make([]byte, l)
 	for i := 0; i < l; i++ {
-		buf[i] = byte(v >> i)
+		buf[l-1-i] = byte(v >> (8 * i))
 	}
 
 	return buf
@@ -99,7 +177,341 @@ func (indexer *Indexer) AddAttrKeyValue(attr string, key int64, value uint64) er
 	if !ok || item == nil {
 		return errors.New("not exsit the attr item in the tree")
 	}
+
+	if item.str {
+		return fmt.Errorf("attribute %s is a string attribute", attr)
+	}
+	if item.timed {
+		return fmt.Errorf("attribute %s is a time attribute", attr)
+	}
 	keys := IntXXToBytes(key, item.byteLen)
+	if indexer.wildcard(attr, value) {
+		return nil
+	}
+
+	if err := item.trie.Put(keys, item.tag, value); err != nil {
+		return err
+	}
+
+	indexer.addMetadata(attr, keys, value)
+	return nil
+}
+
+// AddAttrString 在字符串属性上索引value
+func (indexer *Indexer) AddAttrString(attr string, s string, value uint64) error {
+	key, err := indexer.StringKey(attr, s)
+	if err != nil {
+		return err
+	}
+
+	if indexer.wildcard(attr, value) {
+		return nil
+	}
+
+	item := indexer.attrItems[attr]
+	if err := item.trie.Put(key, item.tag, value); err != nil {
+		return err
+	}
+
+	item.addStringID(key)
+	indexer.addMetadata(attr, key, value)
+	return nil
+}
+
+// StringKey 字符串在属性trie中的key, 用于构造 trie.Eq、trie.Prefix 和 trie.Range 等过滤表达式
+func (indexer *Indexer) StringKey(attr string, s string) ([]byte, error) {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil {
+		return nil, errors.New("not exsit the attr item in the tree")
+	}
+
+	if !item.str {
+		return nil, fmt.Errorf("attribute %s is not a string attribute", attr)
+	}
+
+	return item.stringKey(s, false)
+}
+
+// FuzzySearch 在字符串属性上查找与s的编辑距离不超过maxEdits的key, 结果按距离排序
+func (indexer *Indexer) FuzzySearch(attr string, s string, maxEdits int, limit int) ([]trie.FuzzyMatch, error) {
+	key, err := indexer.StringKey(attr, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return indexer.attrItems[attr].trie.FuzzySearch(key, maxEdits, limit), nil
+}
+
+// stringKey 按属性设置转换大小写, prefix 为true时允许空字符串
+func (item *attrItem) stringKey(s string, prefix bool) ([]byte, error) {
+	if s == "" && !prefix {
+		return nil, errors.New("empty string can not be indexed")
+	}
+
+	if item.fold {
+		s = strings.ToLower(s)
+	}
+
+	return []byte(s), nil
+}
+
+// addStringID 为新的字符串key分配编号
+func (item *attrItem) addStringID(key []byte) {
+	if _, ok := item.ids[string(key)]; !ok {
+		item.ids[string(key)] = item.nextID
+		item.nextID++
+	}
+}
 
-	return item.trie.Put(keys, item.tag, value)
+// AddAttrAny 将value标记为在该属性上通配, 不展开到整个key空间;
+// 通配覆盖该属性上已有的key, 这些key从trie中删除, 之后写入的key也不再存储
+func (indexer *Indexer) AddAttrAny(attr string, value uint64) error {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil {
+		return errors.New("not exsit the attr item in the tree")
+	}
+
+	if md, ok := indexer.metadataTable[int64(value)]; ok {
+		if _, ok := md.attrs[attr]; ok {
+			item.removeValue(md, attr, value)
+			delete(md.negated, attr)
+			delete(md.ternary, attr)
+		}
+	}
+
+	item.any.Add(value)
+	indexer.addMetadata(attr, nil, value)
+	return nil
+}
+
+// wildcard value在属性上是否已经通配
+func (indexer *Indexer) wildcard(attr string, value uint64) bool {
+	md, ok := indexer.metadataTable[int64(value)]
+	if !ok {
+		return false
+	}
+
+	keys, ok := md.attrs[attr]
+	return ok && keys == nil
+}
+
+// AddAttrConstraint 按约束索引value, 约束被拆分为按字节对齐的前缀存储
+func (indexer *Indexer) AddAttrConstraint(attr string, c Constraint, value uint64) error {
+	return indexer.AddAttrConstraints(attr, []Constraint{c}, value)
+}
+
+// AddAttrConstraints 在同一个属性上按多个约束索引value, 约束之间为或的关系, 任意约束通配时该属性通配;
+// 取反的约束合并为一个排除集合存储在notTrie中, 三态约束存储在ternaryTrie中; 任意约束出错时不写入
+func (indexer *Indexer) AddAttrConstraints(attr string, cs []Constraint, value uint64) error {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil {
+		return errors.New("not exsit the attr item in the tree")
+	}
+
+	if item.str {
+		return fmt.Errorf("attribute %s is a string attribute", attr)
+	}
+	if item.timed {
+		return fmt.Errorf("attribute %s is a time attribute", attr)
+	}
+
+	ak, err := constraintKeys(cs, item.byteLen)
+	if err != nil {
+		return fmt.Errorf("attribute %s: %v", attr, err)
+	}
+	negate := ak.negate
+
+	if indexer.wildcard(attr, value) {
+		return nil
+	}
+
+	if md, ok := indexer.metadataTable[int64(value)]; ok {
+		if _, ok := md.attrs[attr]; ok && md.negated[attr] != negate {
+			return fmt.Errorf("attribute %s: negated and plain constraints can not be mixed", attr)
+		}
+	}
+
+	if ak.any() {
+		return indexer.AddAttrAny(attr, value)
+	}
+
+	t := item.trie
+	if negate {
+		t = item.notTrie
+		item.not.Add(value)
+	}
+
+	for _, key := range ak.keys {
+		if err := t.Put(key, item.tag, value); err != nil {
+			return err
+		}
+
+		indexer.addMetadata(attr, key, value)
+	}
+
+	for _, key := range ak.ternary {
+		if err := item.ternaryTrie.Put(key, item.tag, value); err != nil {
+			return err
+		}
+		item.ternaryValues.Add(value)
+
+		indexer.addTernaryMetadata(attr, key, value)
+	}
+
+	if negate {
+		md := indexer.metadataTable[int64(value)]
+		if md.negated == nil {
+			md.negated = make(map[string]bool)
+		}
+		md.negated[attr] = true
+	}
+
+	return nil
+}
+
+// notMatching 带取反约束且排除集合不包含key的value, key的长度小于属性长度时只排除前缀被存储的value
+func (item *attrItem) notMatching(key []byte, stats *trie.ScanStats) *vpack.VPack {
+	if item.not.Size() == 0 {
+		return item.not
+	}
+
+	excluded := vpack.NewValuePack(0, 0)
+	item.notTrie.PrefixesOf(key, stats, func(k []byte, vals *vpack.VPack) bool {
+		excluded.Merge(vals)
+		return true
+	})
+
+	return vpack.Difference(item.not, excluded)
+}
+
+// ternaryMatching 三态约束满足 key&mask == value&mask 的value
+func (item *attrItem) ternaryMatching(key []byte, stats *trie.ScanStats) *vpack.VPack {
+	pack := vpack.NewValuePack(0, 0)
+	if item.ternaryValues.Size() == 0 {
+		return pack
+	}
+
+	item.ternaryTrie.TernaryMatch(key, stats, func(k []byte, vals *vpack.VPack) bool {
+		pack.Merge(vals)
+		return true
+	})
+
+	return pack
+}
+
+// Delete 删除value在所有属性上的key和正排信息, value不存在时返回false
+func (indexer *Indexer) Delete(value uint64) bool {
+	md, ok := indexer.metadataTable[int64(value)]
+	if !ok {
+		return false
+	}
+
+	for attr := range md.attrs {
+		item, ok := indexer.attrItems[attr]
+		if !ok || item == nil {
+			continue
+		}
+
+		item.removeValue(md, attr, value)
+	}
+
+	indexer.unsetPriority(value, md.priority)
+	delete(indexer.metadataTable, int64(value))
+	indexer.all.Remove(value)
+
+	return true
+}
+
+// removeValue 删除value在属性上的key、通配和三态key, 不修改正排信息;
+// 字符串key不再被任何value使用时删除其编号
+func (item *attrItem) removeValue(md *Metadata, attr string, value uint64) {
+	item.stats = nil
+
+	keys := md.attrs[attr]
+	if keys == nil {
+		item.any.Remove(value)
+		return
+	}
+
+	t := item.trie
+	if md.negated[attr] {
+		t = item.notTrie
+		item.not.Remove(value)
+	}
+	for _, key := range keys {
+		t.Delete(key, value)
+
+		if item.str {
+			if pack := item.trie.Lookup(key); pack == nil || pack.Size() == 0 {
+				delete(item.ids, string(key))
+			}
+		}
+	}
+
+	if ternary := md.ternary[attr]; len(ternary) > 0 {
+		for _, key := range ternary {
+			item.ternaryTrie.Delete(key, value)
+		}
+		item.ternaryValues.Remove(value)
+	}
+}
+
+// addTernaryMetadata 记录value在属性上的三态key, 只有三态key的属性在attrs中为空的非nil切片
+func (indexer *Indexer) addTernaryMetadata(attr string, key []byte, value uint64) {
+	md := indexer.metadata(value)
+	if _, ok := md.attrs[attr]; !ok {
+		md.attrs[attr] = [][]byte{}
+	}
+
+	if md.ternary == nil {
+		md.ternary = make(map[string][][]byte)
+	}
+	for _, k := range md.ternary[attr] {
+		if bytes.Equal(k, key) {
+			return
+		}
+	}
+	md.ternary[attr] = append(md.ternary[attr], key)
+
+	indexer.staleStats(attr)
+	indexer.all.Add(value)
+}
+
+func (indexer *Indexer) metadata(value uint64) *Metadata {
+	md, ok := indexer.metadataTable[int64(value)]
+	if !ok {
+		md = &Metadata{attrs: make(map[string][][]byte)}
+		indexer.metadataTable[int64(value)] = md
+	}
+
+	return md
+}
+
+// addMetadata 记录value在属性上的key, key为nil表示通配
+func (indexer *Indexer) addMetadata(attr string, key []byte, value uint64) {
+	md := indexer.metadata(value)
+
+	keys, ok := md.attrs[attr]
+	switch {
+	case key == nil:
+		md.attrs[attr] = nil
+	case !ok || keys != nil:
+		// 已经通配时调用方不再写入具体的key, 重复的key只记录一次
+		for _, k := range keys {
+			if bytes.Equal(k, key) {
+				return
+			}
+		}
+		md.attrs[attr] = append(keys, key)
+	}
+
+	indexer.staleStats(attr)
+	indexer.all.Add(value)
+}
+
+// staleStats 属性上的key发生变化, 丢弃已收集的统计信息
+func (indexer *Indexer) staleStats(attr string) {
+	if item, ok := indexer.attrItems[attr]; ok && item != nil {
+		item.stats = nil
+	}
 }
@@ -0,0 +1,466 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// RulePair 两条规则之间的关系, First 是优先的规则
+type RulePair struct {
+	First  uint64
+	Second uint64
+}
+
+// Analysis 规则集的分析结果, 每一类按 (First, Second) 排序
+type Analysis struct {
+	// Shadowed Second 被优先的 First 完全覆盖, 永远不会被首先匹配
+	Shadowed []RulePair
+	// Redundant 两条规则的匹配空间完全相同
+	Redundant []RulePair
+	// Overlapping 两条规则的匹配空间相交, 但互不包含
+	Overlapping []RulePair
+	// Skipped 三态mask过于分散, 无法转换为区间而没有参与分析的规则, 按id排序
+	Skipped []uint64
+}
+
+// interval 属性上的闭区间
+type interval struct {
+	start uint64
+	end   uint64
+}
+
+// ruleSpace 规则的匹配空间, 每个属性上为有序且互不相邻的区间, 为nil表示通配
+type ruleSpace map[string][]interval
+
+// Analyze 分析所有规则之间的覆盖关系
+// 只比较两两之间的关系, 被多条规则共同覆盖的规则不会报告为Shadowed;
+// 每条规则只与通过属性trie找到的相交规则比较, 而不是与所有规则比较
+func (indexer *Indexer) Analyze() *Analysis {
+	ret := &Analysis{}
+
+	spaces := make(map[uint64]ruleSpace, len(indexer.metadataTable))
+	for id, md := range indexer.metadataTable {
+		space, ok := indexer.ruleSpace(md)
+		if !ok {
+			ret.Skipped = append(ret.Skipped, uint64(id))
+			continue
+		}
+		spaces[uint64(id)] = space
+	}
+	sort.Slice(ret.Skipped, func(i, j int) bool {
+		return ret.Skipped[i] < ret.Skipped[j]
+	})
+
+	for _, b := range indexer.all.Unpack() {
+		md := indexer.metadataTable[int64(b)]
+		space, ok := spaces[b]
+		if !ok {
+			continue
+		}
+
+		for _, a := range indexer.candidates(md).Unpack() {
+			// 每一对规则只处理一次
+			if a <= b {
+				continue
+			}
+
+			other, ok := spaces[a]
+			if !ok || !space.overlaps(other) {
+				continue
+			}
+
+			coverAB, coverBA := other.covers(space), space.covers(other)
+
+			first, second := b, a
+			if indexer.better(a, b) {
+				first, second = a, b
+			}
+			pair := RulePair{First: first, Second: second}
+
+			switch {
+			case coverAB && coverBA:
+				ret.Redundant = append(ret.Redundant, pair)
+			case coverAB && first == a, coverBA && first == b:
+				ret.Shadowed = append(ret.Shadowed, pair)
+			case !coverAB && !coverBA:
+				ret.Overlapping = append(ret.Overlapping, pair)
+			}
+		}
+	}
+
+	for _, pairs := range [][]RulePair{ret.Shadowed, ret.Redundant, ret.Overlapping} {
+		sortPairs(pairs)
+	}
+
+	return ret
+}
+
+// candidates 在候选最少的属性上与md相交的value;
+// 在属性上与key相交的key要么是它的前缀, 要么以它为前缀; 取反和三态的属性按通配处理, 取反和三态的value总是候选
+func (indexer *Indexer) candidates(md *Metadata) *vpack.VPack {
+	var (
+		best     *attrItem
+		bestKeys [][]byte
+		bestNum  int
+	)
+	for attr, item := range indexer.attrItems {
+		keys, ok := md.attrs[attr]
+		if !ok || keys == nil || md.negated[attr] || len(md.ternary[attr]) > 0 {
+			// 通配的属性与所有value相交
+			continue
+		}
+
+		num := item.any.Count() + item.not.Count() + item.ternaryValues.Count()
+		for _, key := range keys {
+			_, values := item.trie.PrefixCount(key)
+			num += values
+			item.trie.PrefixesOf(key, nil, func(k []byte, vals *vpack.VPack) bool {
+				num += vals.Count()
+				return true
+			})
+		}
+
+		if best == nil || num < bestNum {
+			best, bestKeys, bestNum = item, keys, num
+		}
+	}
+
+	if best == nil {
+		return indexer.all
+	}
+
+	packs := []*vpack.VPack{best.any, best.not, best.ternaryValues}
+	collect := func(k []byte, vals *vpack.VPack) bool {
+		packs = append(packs, vals)
+		return true
+	}
+	for _, key := range bestKeys {
+		best.trie.PrefixesOf(key, nil, collect)
+		best.trie.PrefixScan(key, collect)
+	}
+
+	return vpack.Union(packs...)
+}
+
+// ternaryExpandLimit 三态key最多展开的区间数量
+const ternaryExpandLimit = 1 << 10
+
+// ruleSpace 将正排信息中的前缀和三态key转换为区间并合并相邻的区间, 取反的属性取补集;
+// 三态key展开的区间数量超过 ternaryExpandLimit 时返回false
+func (indexer *Indexer) ruleSpace(md *Metadata) (ruleSpace, bool) {
+	space := make(ruleSpace, len(md.attrs))
+	for attr, keys := range md.attrs {
+		if keys == nil {
+			space[attr] = nil
+			continue
+		}
+
+		item, ok := indexer.attrItems[attr]
+		if !ok {
+			return nil, false
+		}
+		width := int(item.byteLen / 8)
+
+		intervals := make([]interval, 0, len(keys))
+		for _, key := range keys {
+			if item.str {
+				// 字符串只比较是否相等, 按编号当作单点区间
+				id := item.ids[string(key)]
+				intervals = append(intervals, interval{start: id, end: id})
+				continue
+			}
+			intervals = append(intervals, prefixInterval(key, width))
+		}
+
+		for _, key := range md.ternary[attr] {
+			ivs, ok := ternaryIntervals(key, width)
+			if !ok {
+				return nil, false
+			}
+			intervals = append(intervals, ivs...)
+		}
+
+		if len(intervals) == 0 {
+			space[attr] = []interval{}
+			continue
+		}
+
+		sort.Slice(intervals, func(i, j int) bool {
+			return intervals[i].start < intervals[j].start
+		})
+
+		merged := intervals[:1]
+		for _, iv := range intervals[1:] {
+			last := &merged[len(merged)-1]
+			if last.end == ^uint64(0) || iv.start <= last.end+1 {
+				if iv.end > last.end {
+					last.end = iv.end
+				}
+				continue
+			}
+			merged = append(merged, iv)
+		}
+
+		if md.negated[attr] {
+			merged = complement(merged, prefixInterval(nil, width).end)
+		}
+		space[attr] = merged
+	}
+
+	return space, true
+}
+
+// ternaryIntervals 将三态key展开为区间: mask 末尾连续的0组成一个区间, 其余为0的位逐个展开
+func ternaryIntervals(key []byte, width int) ([]interval, bool) {
+	valueBytes, maskBytes := trie.ParseTernaryKey(key, width)
+
+	var value, mask uint64
+	for i := 0; i < width; i++ {
+		value = value<<8 | uint64(valueBytes[i])
+		mask = mask<<8 | uint64(maskBytes[i])
+	}
+
+	low := uint(bits.TrailingZeros64(mask))
+	size := uint64(1)<<low - 1
+	free := (prefixInterval(nil, width).end &^ mask) &^ size
+	if bits.OnesCount64(free) > bits.TrailingZeros64(ternaryExpandLimit) {
+		return nil, false
+	}
+
+	// 枚举free的所有子集
+	var ret []interval
+	sub := free
+	for {
+		start := value | sub
+		ret = append(ret, interval{start: start, end: start | size})
+
+		if sub == 0 {
+			break
+		}
+		sub = (sub - 1) & free
+	}
+
+	return ret, true
+}
+
+// complement [0, max]中不在intervals中的区间, 排除整个取值空间时返回空的非nil切片
+func complement(intervals []interval, max uint64) []interval {
+	ret := []interval{}
+
+	var start uint64
+	for _, iv := range intervals {
+		if iv.start > start {
+			ret = append(ret, interval{start: start, end: iv.start - 1})
+		}
+
+		if iv.end == max {
+			return ret
+		}
+		start = iv.end + 1
+	}
+
+	return append(ret, interval{start: start, end: max})
+}
+
+// prefixInterval 以key为前缀的所有width字节的取值
+func prefixInterval(key []byte, width int) interval {
+	var iv interval
+	for i := 0; i < width; i++ {
+		var b, fill byte = 0, 0xff
+		if i < len(key) {
+			b, fill = key[i], key[i]
+		}
+
+		iv.start = iv.start<<8 | uint64(b)
+		iv.end = iv.end<<8 | uint64(fill)
+	}
+
+	return iv
+}
+
+// overlaps 两个匹配空间是否相交
+func (space ruleSpace) overlaps(other ruleSpace) bool {
+	for attr, intervals := range space {
+		otherIntervals, ok := other[attr]
+		if intervals == nil || !ok || otherIntervals == nil {
+			continue
+		}
+
+		if !intervalsOverlap(intervals, otherIntervals) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// covers space是否包含other
+func (space ruleSpace) covers(other ruleSpace) bool {
+	for attr, intervals := range space {
+		if intervals == nil {
+			continue
+		}
+
+		otherIntervals, ok := other[attr]
+		if !ok || otherIntervals == nil || !intervalsCover(intervals, otherIntervals) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func intervalsOverlap(a, b []interval) bool {
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if a[i].start <= b[j].end && b[j].start <= a[i].end {
+			return true
+		}
+
+		if a[i].end < b[j].end {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return false
+}
+
+// intervalsCover a是否包含b, 区间互不相邻, b的每个区间都必须落在a的某个区间中
+func intervalsCover(a, b []interval) bool {
+	var i int
+	for _, iv := range b {
+		for i < len(a) && a[i].end < iv.start {
+			i++
+		}
+
+		if i == len(a) || a[i].start > iv.start || a[i].end < iv.end {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OverlapKind 单个属性上两个匹配空间的关系
+type OverlapKind int
+
+const (
+	// OverlapPartial 相交但互不包含
+	OverlapPartial OverlapKind = iota
+	// OverlapContains 给定规则包含已有规则
+	OverlapContains
+	// OverlapContained 给定规则被已有规则包含
+	OverlapContained
+	// OverlapEqual 完全相同
+	OverlapEqual
+)
+
+func (k OverlapKind) String() string {
+	switch k {
+	case OverlapContains:
+		return "contains"
+	case OverlapContained:
+		return "contained"
+	case OverlapEqual:
+		return "equal"
+	}
+
+	return "partial"
+}
+
+// Overlap 与给定规则相交的已有规则, Attrs 为每个属性上的关系
+type Overlap struct {
+	ID    uint64
+	Attrs map[string]OverlapKind
+}
+
+// Overlapping 查找匹配空间与给定约束相交的所有value, 按id排序; constraints 中没有的属性视为通配,
+// 三态mask过于分散的value不在结果中
+func (indexer *Indexer) Overlapping(constraints map[string]Constraint) ([]Overlap, error) {
+	query := &Metadata{attrs: make(map[string][][]byte, len(indexer.attrItems))}
+	for attr, item := range indexer.attrItems {
+		c, ok := constraints[attr]
+		if !ok {
+			c = Any()
+		} else if item.str {
+			return nil, fmt.Errorf("attribute %s is a string attribute", attr)
+		}
+
+		ak, err := constraintKeys([]Constraint{c}, item.byteLen)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", attr, err)
+		}
+
+		switch {
+		case ak.any():
+			query.attrs[attr] = nil
+		case ak.ternary != nil:
+			query.attrs[attr] = [][]byte{}
+			query.ternary = map[string][][]byte{attr: ak.ternary}
+		default:
+			query.attrs[attr] = ak.keys
+			if ak.negate {
+				query.negated = map[string]bool{attr: true}
+			}
+		}
+	}
+
+	space, ok := indexer.ruleSpace(query)
+	if !ok {
+		return nil, errors.New("ternary mask is too scattered to analyze")
+	}
+
+	var ret []Overlap
+	for _, id := range indexer.candidates(query).Unpack() {
+		md, ok := indexer.metadataTable[int64(id)]
+		if !ok {
+			continue
+		}
+
+		other, ok := indexer.ruleSpace(md)
+		if !ok || !space.overlaps(other) {
+			continue
+		}
+
+		overlap := Overlap{ID: id, Attrs: make(map[string]OverlapKind, len(space))}
+		for attr, intervals := range space {
+			overlap.Attrs[attr] = overlapKind(intervals, other[attr])
+		}
+		ret = append(ret, overlap)
+	}
+
+	return ret, nil
+}
+
+// overlapKind a与b相交时的关系, nil表示通配
+func overlapKind(a, b []interval) OverlapKind {
+	aCoverB := a == nil || (b != nil && intervalsCover(a, b))
+	bCoverA := b == nil || (a != nil && intervalsCover(b, a))
+
+	switch {
+	case aCoverB && bCoverA:
+		return OverlapEqual
+	case aCoverB:
+		return OverlapContains
+	case bCoverA:
+		return OverlapContained
+	}
+
+	return OverlapPartial
+}
+
+func sortPairs(pairs []RulePair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].First != pairs[j].First {
+			return pairs[i].First < pairs[j].First
+		}
+		return pairs[i].Second < pairs[j].Second
+	})
+}
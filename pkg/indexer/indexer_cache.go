@@ -0,0 +1,290 @@
+package pkg
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// ResultCache 查询结果的LRU缓存, key为规范化的过滤表达式, 结果以压缩的VPack保存;
+// 写入或删除value时只淘汰依赖的key范围与value的key相交的结果
+type ResultCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+// CacheStats 缓存的命中和淘汰情况, Evictions 为超过容量的淘汰, Invalidations 为写入导致的淘汰
+type CacheStats struct {
+	Entries       int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+type cacheEntry struct {
+	key  string
+	pack *vpack.VPack
+	deps *filterDeps
+}
+
+// filterDeps 查询结果依赖的属性谓词, all 为true时依赖所有value, 例如带取反的查询
+type filterDeps struct {
+	all   bool
+	preds map[string][]trie.Predicate
+}
+
+// NewResultCache 创建最多保存capacity个结果的缓存
+func NewResultCache(capacity int) *ResultCache {
+	return &ResultCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get 返回缓存的结果, 返回的VPack可以被修改
+func (c *ResultCache) Get(key string) (*vpack.VPack, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+
+	pack := vpack.NewValuePack(0, 0)
+	pack.Merge(elem.Value.(*cacheEntry).pack)
+	return pack, true
+}
+
+// Put 缓存过滤表达式f的结果, key 为 FilterKey(f)
+func (c *ResultCache) Put(key string, f trie.Filter, pack *vpack.VPack) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	saved := vpack.NewValuePack(0, 0)
+	saved.Merge(pack)
+	entry := &cacheEntry{key: key, pack: saved, deps: newFilterDeps(f)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Invalidate 淘汰结果可能因value的变化而改变的缓存, md 为value变化前或变化后的正排信息
+func (c *ResultCache) Invalidate(md *Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cacheEntry).deps.touched(md) {
+			c.remove(elem)
+			c.stats.Invalidations++
+		}
+		elem = next
+	}
+}
+
+// Purge 清空缓存
+func (c *ResultCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Stats 返回缓存的统计信息
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+func (c *ResultCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// newFilterDeps 收集过滤表达式依赖的谓词; 满足查询的value至少在一个属性上满足某个谓词,
+// 取反和空的与表达式不检查任何属性, 依赖所有value
+func newFilterDeps(f trie.Filter) *filterDeps {
+	deps := &filterDeps{preds: make(map[string][]trie.Predicate)}
+
+	var visit func(f trie.Filter)
+	visit = func(f trie.Filter) {
+		switch f := f.(type) {
+		case *trie.AttrFilter:
+			deps.preds[f.Attr] = append(deps.preds[f.Attr], f.Pred)
+		case *trie.AndFilter:
+			if len(f.Filters) == 0 {
+				deps.all = true
+			}
+			for _, child := range f.Filters {
+				visit(child)
+			}
+		case *trie.OrFilter:
+			for _, child := range f.Filters {
+				visit(child)
+			}
+		default:
+			deps.all = true
+		}
+	}
+	visit(f)
+
+	return deps
+}
+
+// touched value在任意属性上的key可能满足依赖的谓词; 通配、取反和三态约束覆盖的范围太大, 按整个属性处理
+func (deps *filterDeps) touched(md *Metadata) bool {
+	if deps.all {
+		return true
+	}
+
+	for attr, keys := range md.attrs {
+		preds := deps.preds[attr]
+		if len(preds) == 0 {
+			continue
+		}
+
+		if keys == nil || md.negated[attr] || len(md.ternary[attr]) > 0 {
+			return true
+		}
+
+		// 存储的key可能是前缀, 以该前缀开头的任意key满足谓词即相交
+		for _, key := range keys {
+			for _, pred := range preds {
+				if pred.Match(key) || pred.Test(key) != trie.CoverNone {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// FilterKey 规范化的过滤表达式, 嵌套的与、或表达式被展开, 子表达式排序并去重;
+// 属性谓词按种类编码, 不同的谓词key不同
+func FilterKey(f trie.Filter) string {
+	switch f := f.(type) {
+	case *trie.AndFilter:
+		return joinFilterKeys(f.Filters, " and ", func(f trie.Filter) []trie.Filter {
+			if and, ok := f.(*trie.AndFilter); ok {
+				return and.Filters
+			}
+			return nil
+		})
+	case *trie.OrFilter:
+		return joinFilterKeys(f.Filters, " or ", func(f trie.Filter) []trie.Filter {
+			if or, ok := f.(*trie.OrFilter); ok {
+				return or.Filters
+			}
+			return nil
+		})
+	case *trie.NotFilter:
+		return "not (" + FilterKey(f.Filter) + ")"
+	case *trie.AttrFilter:
+		return f.Attr + " " + predicateKey(f.Pred)
+	default:
+		return fmt.Sprintf("%T %s", f, f)
+	}
+}
+
+// predicateKey 谓词的key, 以谓词的种类开头; String 只用于显示, 不同种类的谓词可能相同
+func predicateKey(pred trie.Predicate) string {
+	// nil 表示不限边界, 与空的key区分
+	bound := func(key []byte) string {
+		if key == nil {
+			return "*"
+		}
+		return fmt.Sprintf("%x", key)
+	}
+
+	switch p := pred.(type) {
+	case *trie.EqPredicate:
+		return fmt.Sprintf("eq %x", p.Key)
+	case *trie.InPredicate:
+		keys := make([]string, 0, len(p.Keys))
+		for _, key := range p.Keys {
+			keys = append(keys, fmt.Sprintf("%x", key))
+		}
+		return "in {" + strings.Join(keys, ",") + "}"
+	case *trie.RangePredicate:
+		return "range [" + bound(p.Start) + "," + bound(p.End) + "]"
+	case *trie.PrefixPredicate:
+		return fmt.Sprintf("prefix %x", p.Prefix)
+	case *trie.CIDRPredicate:
+		return fmt.Sprintf("cidr %x/%d", p.IP, p.Bits)
+	case *trie.RegexpPredicate:
+		return fmt.Sprintf("regexp %q", p.Expr)
+	default:
+		return fmt.Sprintf("%T %s", p, p)
+	}
+}
+
+// joinFilterKeys children 返回与当前表达式同类的子表达式的子结点, 不同类时返回nil
+func joinFilterKeys(filters []trie.Filter, sep string, children func(trie.Filter) []trie.Filter) string {
+	seen := make(map[string]bool)
+	var keys []string
+
+	var visit func(filters []trie.Filter)
+	visit = func(filters []trie.Filter) {
+		for _, f := range filters {
+			if sub := children(f); sub != nil {
+				visit(sub)
+				continue
+			}
+
+			key := FilterKey(f)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	visit(filters)
+
+	switch len(keys) {
+	case 0:
+		// 空的与表达式满足所有value, 空的或表达式不满足任何value
+		return strings.TrimSpace(sep)
+	case 1:
+		// 只有一个子表达式时与子表达式相同
+		return keys[0]
+	}
+
+	sort.Strings(keys)
+	return "(" + strings.Join(keys, ")"+sep+"(") + ")"
+}
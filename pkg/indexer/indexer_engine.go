@@ -1,18 +1,58 @@
 package pkg
 
-import "sync/atomic"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// SearchRule 查询条件, Attr 返回错误的属性不参与过滤,
+// Filter 返回额外的过滤表达式, 例如 sip in 10/8 and not svc in (22, 23), 为nil时忽略
 type SearchRule interface {
 	Attr(key string) (uint64, error)
-	Filter()
+	Filter() trie.Filter
 }
 
+// IndexRule 索引规则, Attr 返回 ErrAnyAttr 时表示该属性通配, 此时返回的id仍然有效
 type IndexRule interface {
 	Attr(key string) (int64, uint64, error)
 }
 
+// ErrAnyAttr 规则没有限定该属性, 匹配任意值
+var ErrAnyAttr = errors.New("attribute matches any value")
+
+// ConstraintRule 使用CIDR、区间和通配约束的索引规则, Constraint 返回 ErrAnyAttr 等同于 Any()
+type ConstraintRule interface {
+	ID() uint64
+	Constraint(key string) (Constraint, error)
+}
+
+// MultiRule 每个属性可以有多个key、前缀或区间的索引规则, 同一属性上的约束之间为或的关系,
+// Constraints 返回 ErrAnyAttr 时表示该属性通配
+type MultiRule interface {
+	ID() uint64
+	Constraints(key string) ([]Constraint, error)
+}
+
+// Analyzer 查询和匹配接口, 带Context的方法在ctx被取消或超时时返回 ctx.Err(), 不返回部分结果
 type Analyzer interface {
 	Search(SearchRule) ([]uint64, error)
+	SearchContext(context.Context, SearchRule) ([]uint64, error)
+	SearchPage(SearchRule, int, string) (*Page, error)
+	Query(string) ([]uint64, error)
+	Explain(SearchRule) (*ExplainStep, error)
+	Match(Flow) ([]uint64, error)
+	MatchContext(context.Context, Flow) ([]uint64, error)
+	MatchBatch([]Flow) ([][]uint64, error)
+	MatchFirst(Flow) (uint64, bool, error)
+	MatchTopK(Flow, int) ([]uint64, error)
 }
 
 type dispatcher struct {
@@ -39,24 +79,59 @@ type engine struct {
 
 	sequencer sequencer
 
+	// mu 保护index、cache和写入代数, 写入和删除规则时持有写锁, 查询和匹配时持有读锁;
+	// 持有锁的方法之间不互相调用. 后台合并不改变查询结果, 只使用index自身的锁
+	mu sync.RWMutex
+
 	indexerNum uint8
-	indexer    *Indexer
+	// schema 没有数据的Indexer, 只用于查找属性和解析查询语句
+	schema *Indexer
+	index  *SegmentedIndex
+
+	// cache 查询结果缓存, 为nil时不缓存
+	cache *ResultCache
+
+	// generation 写入代数, 每次修改规则时增加, 用于判断分页游标之后是否有写入
+	generation uint64
+	pages      pageSnapshots
 }
 
+const (
+	// engineMemtableSize memtable封存为不可变段时的规则数量
+	engineMemtableSize = 1 << 16
+	// compactionInterval 后台合并的检查间隔
+	compactionInterval = time.Second
+)
+
 func NewIndexerEngine() (Analyzer, error) {
+	return newIndexerEngine(engineMemtableSize, nil)
+}
+
+// newIndexerEngine 创建引擎, memtableSize 和 policy 见 NewSegmentedIndex
+func newIndexerEngine(memtableSize int, policy CompactionPolicy) (*engine, error) {
 	e := &engine{}
 
-	indexer, err := Builder().
-		AddAttrItem("sip", 32, 0).
-		AddAttrItem("dip", 32, 0).
-		AddAttrItem("svc", 32, 0).
-		Build()
+	build := func() (*Indexer, error) {
+		return Builder().
+			AddAttrItem("sip", 32, 0).
+			AddAttrItem("dip", 32, 0).
+			AddAttrItem("svc", 32, 0).
+			Build()
+	}
+
+	schema, err := build()
+	if err != nil {
+		return nil, err
+	}
 
+	index, err := NewSegmentedIndex(build, memtableSize, policy)
 	if err != nil {
 		return nil, err
 	}
 
-	e.indexer = indexer
+	e.schema = schema
+	e.index = index
+	e.pages.init(maxPageSnapshots)
 
 	e.sequencer.InitSequence(10000)
 
@@ -64,29 +139,405 @@ func NewIndexerEngine() (Analyzer, error) {
 }
 
 func (e *engine) Search(r SearchRule) ([]uint64, error) {
+	return e.SearchContext(context.Background(), r)
+}
 
-	return nil, nil
+// SearchContext 同 Search, 遍历trie和合并结果的过程中定期检查ctx
+func (e *engine) SearchContext(ctx context.Context, r SearchRule) ([]uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	pack, err := e.search(ctx, e.searchFilter(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return pack.Unpack(), nil
 }
 
-func (e *engine) Index(r IndexRule) ([]uint64, error) {
-	indexer := e.indexer
+// search 计算过滤表达式的结果, 设置了缓存时优先使用缓存
+func (e *engine) search(ctx context.Context, f trie.Filter) (*vpack.VPack, error) {
+	if e.cache == nil {
+		return e.index.FilterContext(ctx, f)
+	}
+
+	key := FilterKey(f)
+	if pack, ok := e.cache.Get(key); ok {
+		return pack, nil
+	}
+
+	pack, err := e.index.FilterContext(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	e.cache.Put(key, f, pack)
+
+	return pack, nil
+}
 
+// SetResultCache 设置查询结果缓存, 为nil时关闭缓存; 写入和删除规则时淘汰受影响的结果
+func (e *engine) SetResultCache(cache *ResultCache) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cache = cache
+}
+
+// touch 增加写入代数并按value的正排信息淘汰缓存, 修改value前后各调用一次
+func (e *engine) touch(ids ...uint64) {
+	atomic.AddUint64(&e.generation, 1)
+	if e.cache == nil {
+		return
+	}
+
+	for _, id := range ids {
+		if md, ok := e.index.metadata(id); ok {
+			e.cache.Invalidate(md)
+		}
+	}
+}
+
+// Explain 执行查询并返回查询计划和每一步的实际执行情况
+func (e *engine) Explain(r SearchRule) (*ExplainStep, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.index.Explain(e.searchFilter(r))
+}
+
+// Query 按查询语句查找, 语法见 Indexer.ParseQuery
+func (e *engine) Query(query string) ([]uint64, error) {
+	f, err := e.schema.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Search(&querySearch{filter: f})
+}
+
+// querySearch 由查询语句生成的查询条件
+type querySearch struct {
+	filter trie.Filter
+}
+
+func (q *querySearch) Attr(key string) (uint64, error) {
+	return 0, errors.New("attribute is not specified")
+}
+
+func (q *querySearch) Filter() trie.Filter {
+	return q.filter
+}
+
+// searchFilter 将查询条件转换为过滤表达式
+func (e *engine) searchFilter(r SearchRule) trie.Filter {
+	indexer := e.schema
+
+	attrNames := make([]string, 0, len(indexer.attrItems))
 	for attrName := range indexer.attrItems {
-		k, v, err := r.Attr(attrName)
+		attrNames = append(attrNames, attrName)
+	}
+	sort.Strings(attrNames)
+
+	var filters []trie.Filter
+	for _, attrName := range attrNames {
+		v, err := r.Attr(attrName)
 		if err != nil {
+			continue
+		}
+
+		key := IntXXToBytes(int64(v), indexer.attrItems[attrName].byteLen)
+		filters = append(filters, trie.Eq(attrName, key))
+	}
+
+	if f := r.Filter(); f != nil {
+		filters = append(filters, f)
+	}
+
+	return trie.And(filters...)
+}
+
+// Index 索引规则, 已有的规则被替换; 任意属性出错时不写入
+func (e *engine) Index(r IndexRule) ([]uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	type attrValue struct {
+		key int64
+		any bool
+	}
+
+	// 按id分组, 每组作为一个规则写入
+	rules := make(map[uint64]map[string]attrValue)
+	for attrName := range e.schema.attrItems {
+		k, v, err := r.Attr(attrName)
+		av := attrValue{key: k}
+		if errors.Is(err, ErrAnyAttr) {
+			av = attrValue{any: true}
+		} else if err != nil {
 			return nil, err
 		}
 
-		indexer.AddAttrKeyValue(attrName, k, v)
+		if rules[v] == nil {
+			rules[v] = make(map[string]attrValue)
+		}
+		rules[v][attrName] = av
+	}
+
+	ids := make([]uint64, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		err := e.put(id, func(indexer *Indexer) error {
+			for attrName, av := range rules[id] {
+				var err error
+				if av.any {
+					err = indexer.AddAttrAny(attrName, id)
+				} else {
+					err = indexer.AddAttrKeyValue(attrName, av.key, id)
+				}
+				if err != nil {
+					return fmt.Errorf("attribute %s: %v", attrName, err)
+				}
+			}
+
+			return setPriority(indexer, r, id)
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return nil, nil
 }
 
-func (e *engine) Start() {
+// IndexConstraint 按约束索引规则, 已有的规则被替换; 任意属性出错时不写入
+func (e *engine) IndexConstraint(r ConstraintRule) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	constraints := make(map[string]Constraint, len(e.schema.attrItems))
+	for attrName, item := range e.schema.attrItems {
+		c, err := r.Constraint(attrName)
+		if errors.Is(err, ErrAnyAttr) {
+			c = Any()
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := constraintKeys([]Constraint{c}, item.byteLen); err != nil {
+			return fmt.Errorf("attribute %s: %v", attrName, err)
+		}
+		constraints[attrName] = c
+	}
 
+	id := r.ID()
+	return e.put(id, func(indexer *Indexer) error {
+		for attrName, c := range constraints {
+			if err := indexer.AddAttrConstraint(attrName, c, id); err != nil {
+				return err
+			}
+		}
+
+		return setPriority(indexer, r, id)
+	})
 }
 
-func (e *engine) Stop() {
+// IndexMulti 按每个属性上的多个约束索引规则, 已有的规则被替换; 任意属性出错时不写入
+func (e *engine) IndexMulti(r MultiRule) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	constraints, err := e.multiConstraints(r)
+	if err != nil {
+		return err
+	}
+
+	return e.indexMulti(r, constraints)
+}
+
+// Delete 删除规则在所有属性上的key
+func (e *engine) Delete(id uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.touch(id)
+	if !e.index.Delete(id) {
+		return fmt.Errorf("rule %d is not indexed", id)
+	}
+
+	return nil
+}
+
+// Update 使用新的约束列表替换规则, 新规则出错时保留旧规则
+func (e *engine) Update(r MultiRule) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	constraints, err := e.multiConstraints(r)
+	if err != nil {
+		return err
+	}
+
+	return e.indexMulti(r, constraints)
+}
+
+// multiConstraints 读取并检查规则在每个属性上的约束
+func (e *engine) multiConstraints(r MultiRule) (map[string][]Constraint, error) {
+	constraints := make(map[string][]Constraint, len(e.schema.attrItems))
+	for attrName, item := range e.schema.attrItems {
+		cs, err := r.Constraints(attrName)
+		if errors.Is(err, ErrAnyAttr) {
+			cs = []Constraint{Any()}
+		} else if err != nil {
+			return nil, err
+		}
+
+		if _, err := constraintKeys(cs, item.byteLen); err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", attrName, err)
+		}
+		constraints[attrName] = cs
+	}
+
+	return constraints, nil
+}
+
+func (e *engine) indexMulti(r MultiRule, constraints map[string][]Constraint) error {
+	id := r.ID()
+	return e.put(id, func(indexer *Indexer) error {
+		for attrName, cs := range constraints {
+			if err := indexer.AddAttrConstraints(attrName, cs, id); err != nil {
+				return err
+			}
+		}
+
+		return setPriority(indexer, r, id)
+	})
+}
+
+// put 写入规则的新版本并替换旧版本, 写入前后按新旧版本淘汰缓存
+func (e *engine) put(id uint64, fn func(indexer *Indexer) error) error {
+	e.touch(id)
+	defer e.touch(id)
+
+	return e.index.Put(id, fn)
+}
+
+// setPriority 所有属性写入后才有正排信息, 规则实现 PriorityRule 时设置优先级
+func setPriority(indexer *Indexer, r interface{}, id uint64) error {
+	if pr, ok := r.(PriorityRule); ok {
+		return indexer.SetPriority(id, pr.Priority())
+	}
+
+	return nil
+}
+
+// Match 查找覆盖五元组的所有规则
+func (e *engine) Match(flow Flow) ([]uint64, error) {
+	return e.MatchContext(context.Background(), flow)
+}
+
+// MatchContext 同 Match, 每个属性查找前和每次求交集前检查ctx
+func (e *engine) MatchContext(ctx context.Context, flow Flow) ([]uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	pack, err := e.index.MatchContext(ctx, flow.values())
+	if err != nil {
+		return nil, err
+	}
+
+	return pack.Unpack(), nil
+}
+
+// MatchFirst 返回覆盖五元组的优先级最高的规则, 没有匹配时返回false
+func (e *engine) MatchFirst(flow Flow) (uint64, bool, error) {
+	ids, err := e.MatchTopK(flow, 1)
+	if err != nil || len(ids) == 0 {
+		return 0, false, err
+	}
+
+	return ids[0], true, nil
+}
+
+// MatchTopK 按优先级返回覆盖五元组的前k个规则
+func (e *engine) MatchTopK(flow Flow, k int) ([]uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	pack, err := e.index.Match(flow.values())
+	if err != nil {
+		return nil, err
+	}
+
+	return e.index.TopK(pack, k), nil
+}
+
+// MatchBatch 批量匹配, 相同的属性取值只查找一次
+func (e *engine) MatchBatch(flows []Flow) ([][]uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	values := make([]map[string]uint64, len(flows))
+	for i := range flows {
+		values[i] = flows[i].values()
+	}
+
+	packs, err := e.index.MatchBatch(values)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([][]uint64, len(packs))
+	for i, pack := range packs {
+		ret[i] = pack.Unpack()
+	}
+
+	return ret, nil
+}
+
+// Overlapping 查找匹配空间与规则相交的已有规则, 不包含规则自身
+func (e *engine) Overlapping(r ConstraintRule) ([]Overlap, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	constraints := make(map[string]Constraint, len(e.schema.attrItems))
+	for attrName := range e.schema.attrItems {
+		c, err := r.Constraint(attrName)
+		if errors.Is(err, ErrAnyAttr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		constraints[attrName] = c
+	}
+
+	overlaps, err := e.index.Overlapping(constraints)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := overlaps[:0]
+	for _, o := range overlaps {
+		if o.ID != r.ID() {
+			ret = append(ret, o)
+		}
+	}
 
+	return ret, nil
+}
+
+// Start 启动后台合并, 已经启动时返回错误
+func (e *engine) Start() error {
+	return e.index.StartCompactor(compactionInterval)
+}
+
+// Stop 停止后台合并并等待正在执行的合并结束
+func (e *engine) Stop() {
+	e.index.StopCompactor()
 }
@@ -0,0 +1,1950 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+)
+
+type testRule struct {
+	id    uint64
+	attrs map[string]int64
+	any   map[string]bool
+}
+
+func (r *testRule) Attr(key string) (int64, uint64, error) {
+	if r.any[key] {
+		return 0, r.id, ErrAnyAttr
+	}
+
+	v, ok := r.attrs[key]
+	if !ok {
+		return 0, 0, errors.New("not exist")
+	}
+
+	return v, r.id, nil
+}
+
+type testPriorityRule struct {
+	testRule
+	priority int
+}
+
+func (r *testPriorityRule) Priority() int {
+	return r.priority
+}
+
+type testSearch struct {
+	attrs  map[string]uint64
+	filter trie.Filter
+}
+
+func (s *testSearch) Attr(key string) (uint64, error) {
+	v, ok := s.attrs[key]
+	if !ok {
+		return 0, errors.New("not exist")
+	}
+
+	return v, nil
+}
+
+func (s *testSearch) Filter() trie.Filter {
+	return s.filter
+}
+
+func ip(a, b, c, d byte) int64 {
+	return int64(a)<<24 | int64(b)<<16 | int64(c)<<8 | int64(d)
+}
+
+func newTestEngine(t *testing.T) *engine {
+	analyzer, err := NewIndexerEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := analyzer.(*engine)
+	rules := []*testRule{
+		{id: 1, attrs: map[string]int64{"sip": ip(10, 0, 0, 1), "dip": ip(192, 168, 1, 1), "svc": 22}},
+		{id: 2, attrs: map[string]int64{"sip": ip(10, 1, 0, 1), "dip": ip(192, 168, 1, 9), "svc": 443}},
+		{id: 3, attrs: map[string]int64{"sip": ip(11, 0, 0, 1), "dip": ip(192, 168, 1, 1), "svc": 80}},
+		{id: 4, attrs: map[string]int64{"sip": ip(10, 2, 0, 1), "dip": ip(172, 16, 0, 1), "svc": 23}},
+	}
+	for _, r := range rules {
+		if _, err := e.Index(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return e
+}
+
+func equalValues(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestEngine_Search(t *testing.T) {
+	e := newTestEngine(t)
+
+	key := func(v int64) []byte {
+		return IntXXToBytes(v, 32)
+	}
+
+	cases := []struct {
+		search *testSearch
+		expect []uint64
+	}{
+		{&testSearch{attrs: map[string]uint64{"svc": 22}}, []uint64{1}},
+		{&testSearch{filter: trie.CIDR("sip", key(ip(10, 0, 0, 0)), 8)}, []uint64{1, 2, 4}},
+		{&testSearch{filter: trie.And(
+			trie.CIDR("sip", key(ip(10, 0, 0, 0)), 8),
+			trie.Not(trie.In("svc", key(22), key(23))),
+		)}, []uint64{2}},
+		{&testSearch{filter: trie.Or(
+			trie.Range("svc", key(80), key(443)),
+			trie.Eq("dip", key(ip(172, 16, 0, 1))),
+		)}, []uint64{2, 3, 4}},
+		{&testSearch{attrs: map[string]uint64{"dip": uint64(ip(192, 168, 1, 1))}, filter: trie.Prefix("sip", []byte{10})}, []uint64{1}},
+		{&testSearch{}, []uint64{1, 2, 3, 4}},
+	}
+
+	for i, c := range cases {
+		ret, err := e.Search(c.search)
+		if err != nil || !equalValues(ret, c.expect) {
+			t.Error("No Pass", i, ret)
+		}
+	}
+
+	if _, err := e.Search(&testSearch{filter: trie.Eq("xxx", key(1))}); err == nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestEngine_Query(t *testing.T) {
+	e := newTestEngine(t)
+
+	cases := []struct {
+		query  string
+		expect []uint64
+	}{
+		{"svc = 22", []uint64{1}},
+		{"sip = 10.0.0.0/8 AND dip IN [192.168.1.1, 192.168.1.9] AND NOT svc = 22", []uint64{2}},
+		{"sip = 10.0.0.0/8 and not svc in [22, 23]", []uint64{2}},
+		{"(svc >= 80 AND svc < 443) OR dip = 172.16.0.1", []uint64{3, 4}},
+		{"svc > 0x16 and svc <= 443", []uint64{2, 3, 4}},
+		{"sip in [11.0.0.0/8, 10.2.0.1]", []uint64{3, 4}},
+		{"sip != 10.0.0.0/15", []uint64{3, 4}},
+		{"svc < 0", nil},
+	}
+
+	for _, c := range cases {
+		ret, err := e.Query(c.query)
+		if err != nil || !equalValues(ret, c.expect) {
+			t.Error("No Pass", c.query, ret, err)
+		}
+	}
+
+	errs := []struct {
+		query  string
+		column int
+	}{
+		{"xxx = 1", 1},
+		{"svc = 1 AND", 12},
+		{"svc = 10.0.0.1/33", 7},
+		{"svc == 1", 6},
+		{"sip = 10.0.0.256", 7},
+		{"svc IN [1, 2", 13},
+		{"(svc = 1", 9},
+		{"svc = 1 sip = 2", 9},
+		{"svc = 4294967296", 7},
+		{"svc = #", 7},
+		{"sip > 10.0.0.0/8", 5},
+		{`svc ~ "1"`, 5},
+		{`svc PREFIX "1"`, 12},
+	}
+
+	for _, c := range errs {
+		_, err := e.Query(c.query)
+		qe, ok := err.(*QueryError)
+		if !ok || qe.Column != c.column {
+			t.Error("No Pass", c.query, err)
+		}
+	}
+}
+
+func TestIndexer_Plan(t *testing.T) {
+	indexer, err := Builder().
+		AddAttrItem("proto", 8, 0).
+		AddAttrItem("port", 16, 0).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// proto 只有两个取值, port 几乎唯一
+	for i := 0; i < 1000; i++ {
+		indexer.AddAttrKeyValue("proto", int64(i%2), uint64(i))
+		indexer.AddAttrKeyValue("port", int64(i), uint64(i))
+	}
+	indexer.CollectStats()
+
+	stats, err := indexer.Stats("proto")
+	if err != nil || stats.Keys != 2 || stats.Postings != 1000 || len(stats.HeavyKeys) != 2 ||
+		stats.HeavyKeys[0].Postings != 500 || stats.Histogram[1] != 500 {
+		t.Error("No Pass", stats)
+	}
+
+	// 写入和删除后统计信息过期, 再次获取时重新收集
+	indexer.AddAttrKeyValue("proto", 1, 1000)
+	if stats, err := indexer.Stats("proto"); err != nil || stats.Postings != 1001 || stats.HeavyKeys[0].Postings != 501 {
+		t.Error("No Pass", stats)
+	}
+	indexer.Delete(1000)
+	if stats, err := indexer.Stats("proto"); err != nil || stats.Postings != 1000 {
+		t.Error("No Pass", stats)
+	}
+
+	proto := trie.Eq("proto", []byte{1})
+	port := trie.Range("port", IntXXToBytes(10, 16), IntXXToBytes(19, 16))
+	notPort := trie.Not(trie.Eq("port", IntXXToBytes(11, 16)))
+
+	plan, err := indexer.Plan(trie.And(proto, notPort, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 范围最小先执行, proto 的posting很大, 改为逐个过滤
+	expect := []struct {
+		filter   trie.Filter
+		strategy Strategy
+	}{
+		{port, StrategyRange},
+		{proto, StrategyFilter},
+		{notPort, StrategyAntiJoin},
+	}
+	for i, e := range expect {
+		child := plan.Children[i]
+		if child.Filter != e.filter || child.Strategy != e.strategy {
+			t.Error("No Pass", i, child.Filter, child.Strategy)
+		}
+	}
+
+	pack, err := indexer.Filter(trie.And(proto, notPort, port))
+	if err != nil || !equalValues(pack.Unpack(), []uint64{13, 15, 17, 19}) {
+		t.Error("No Pass", err)
+	}
+
+	// 覆盖几乎所有value的范围直接过滤全集
+	broad := trie.Range("port", IntXXToBytes(1, 16), nil)
+	if plan, err := indexer.Plan(broad); err != nil || plan.Strategy != StrategyFilter {
+		t.Error("No Pass", err)
+	}
+	if pack, err := indexer.Filter(broad); err != nil || pack.Count() != 999 {
+		t.Error("No Pass", err)
+	}
+
+	if plan, err := indexer.Plan(trie.Not(proto)); err != nil || plan.Strategy != StrategyNegate || plan.Estimate != 500 {
+		t.Error("No Pass", err)
+	}
+}
+
+func TestEngine_Explain(t *testing.T) {
+	e := newTestEngine(t)
+
+	key := func(v int64) []byte {
+		return IntXXToBytes(v, 32)
+	}
+
+	step, err := e.Explain(&testSearch{
+		attrs:  map[string]uint64{"svc": 443},
+		filter: trie.Not(trie.Eq("sip", key(ip(10, 1, 0, 1)))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// svc = 443 先执行, 只剩一个候选, NOT 直接过滤候选后为空
+	if step.Strategy != StrategyIntersect || step.Actual != 0 || len(step.Children) != 2 {
+		t.Fatal("No Pass", step)
+	}
+
+	point := step.Children[0]
+	if point.Attr != "svc" || point.Strategy != StrategyPoint || point.Actual != 1 || point.Blocks != 1 ||
+		point.Scan.Keys != 1 || point.Scan.Nodes == 0 || point.Scan.Chunks == 0 {
+		t.Error("No Pass", point)
+	}
+
+	filter := step.Children[1]
+	if filter.Strategy != StrategyFilter || filter.Skipped || filter.Candidates != 1 || filter.Actual != 0 {
+		t.Error("No Pass", filter)
+	}
+
+	// 结果为空后剩余的结点不再执行
+	step, err = e.Explain(&testSearch{attrs: map[string]uint64{"svc": 1, "dip": uint64(ip(192, 168, 1, 1))}})
+	if err != nil || len(step.Children) != 2 || step.Children[0].Attr != "svc" || !step.Children[1].Skipped {
+		t.Fatal("No Pass", step, err)
+	}
+
+	text := step.String()
+	if !strings.HasPrefix(text, "intersect: ") || !strings.Contains(text, "\n  point svc: ") ||
+		!strings.Contains(text, "skipped") {
+		t.Error("No Pass", text)
+	}
+}
+
+func TestEngine_Any(t *testing.T) {
+	e := newTestEngine(t)
+
+	// 任意源地址访问 192.168.1.1 的任意服务
+	rule := &testRule{
+		id:    5,
+		attrs: map[string]int64{"dip": ip(192, 168, 1, 1)},
+		any:   map[string]bool{"sip": true, "svc": true},
+	}
+	if _, err := e.Index(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Index(&testRule{id: 6, attrs: map[string]int64{"svc": 1}}); err == nil {
+		t.Error("No Pass")
+	}
+
+	cases := []struct {
+		query  string
+		expect []uint64
+	}{
+		{"svc = 443", []uint64{2, 5}},
+		{"svc = 443 and dip = 192.168.1.1", []uint64{5}},
+		{"sip = 11.0.0.0/8 and svc in [80, 8080]", []uint64{3, 5}},
+		{"svc >= 80", []uint64{2, 3, 5}},
+		{"dip = 172.16.0.1", []uint64{4}},
+		// 通配的规则也可能匹配22, 不属于补集
+		{"not svc = 22", []uint64{2, 3, 4}},
+	}
+
+	for _, c := range cases {
+		ret, err := e.Query(c.query)
+		if err != nil || !equalValues(ret, c.expect) {
+			t.Error("No Pass", c.query, ret, err)
+		}
+	}
+
+	stats, err := e.index.memtable.Stats("svc")
+	if err != nil || stats.Any != 1 || stats.Postings != 4 {
+		t.Error("No Pass", stats, err)
+	}
+}
+
+type testConstraintRule struct {
+	id          uint64
+	constraints map[string]Constraint
+	priority    int
+}
+
+func (r *testConstraintRule) ID() uint64 {
+	return r.id
+}
+
+func (r *testConstraintRule) Priority() int {
+	return r.priority
+}
+
+func (r *testConstraintRule) Constraint(key string) (Constraint, error) {
+	c, ok := r.constraints[key]
+	if !ok {
+		return Constraint{}, ErrAnyAttr
+	}
+
+	return c, nil
+}
+
+// newMatchEngine 规则1和4优先级最高, 规则2最低
+func newMatchEngine(t *testing.T) *engine {
+	analyzer, err := NewIndexerEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := analyzer.(*engine)
+
+	u := func(v int64) uint64 {
+		return uint64(v)
+	}
+
+	rules := []*testConstraintRule{
+		{1, map[string]Constraint{"sip": CIDR(u(ip(10, 0, 0, 0)), 8), "svc": Interval(Service(6, 80), Service(6, 443))}, 10},
+		{2, map[string]Constraint{"dip": CIDR(u(ip(192, 168, 1, 0)), 24)}, 100},
+		{3, map[string]Constraint{"sip": CIDR(u(ip(10, 1, 0, 0)), 12), "dip": Value(u(ip(192, 168, 1, 1))), "svc": Value(Service(17, 53))}, 50},
+		{4, map[string]Constraint{"sip": CIDR(0, 0), "svc": Interval(Service(6, 443), Service(6, 65535))}, 10},
+	}
+	for _, r := range rules {
+		if err := e.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return e
+}
+
+func TestEngine_Match(t *testing.T) {
+	e := newMatchEngine(t)
+
+	bad := &testConstraintRule{5, map[string]Constraint{"svc": Value(1), "sip": CIDR(0, 33)}, 0}
+	if err := e.IndexConstraint(bad); err == nil || e.index.memtable.all.Contains(5) {
+		t.Error("No Pass", err)
+	}
+
+	cases := []struct {
+		flow   Flow
+		expect []uint64
+	}{
+		{Flow{SrcIP: uint32(ip(10, 1, 2, 3)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, SrcPort: 5000, DstPort: 443}, []uint64{1, 2, 4}},
+		{Flow{SrcIP: uint32(ip(10, 15, 0, 1)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 17, DstPort: 53}, []uint64{2, 3}},
+		{Flow{SrcIP: uint32(ip(10, 16, 0, 1)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 17, DstPort: 53}, []uint64{2}},
+		{Flow{SrcIP: uint32(ip(8, 8, 8, 8)), DstIP: uint32(ip(1, 1, 1, 1)), Proto: 6, DstPort: 8080}, []uint64{4}},
+		{Flow{SrcIP: uint32(ip(8, 8, 8, 8)), DstIP: uint32(ip(1, 1, 1, 1)), Proto: 6, DstPort: 22}, nil},
+	}
+
+	flows := make([]Flow, 0, len(cases)*2)
+	for i, c := range cases {
+		ret, err := e.Match(c.flow)
+		if err != nil || !equalValues(ret, c.expect) {
+			t.Error("No Pass", i, ret, err)
+		}
+		flows = append(flows, c.flow, c.flow)
+	}
+
+	batch, err := e.MatchBatch(flows)
+	if err != nil || len(batch) != len(flows) {
+		t.Fatal("No Pass", err)
+	}
+	for i, ret := range batch {
+		if !equalValues(ret, cases[i/2].expect) {
+			t.Error("No Pass", i, ret)
+		}
+	}
+}
+
+func TestIntervalKeys(t *testing.T) {
+	keys := intervalKeys(0x0a0000ff, 0x0a000300, 4)
+	expect := [][]byte{{10, 0, 0, 0xff}, {10, 0, 1}, {10, 0, 2}, {10, 0, 3, 0}}
+	if len(keys) != len(expect) {
+		t.Fatal("No Pass", keys)
+	}
+	for i := range keys {
+		if string(keys[i]) != string(expect[i]) {
+			t.Error("No Pass", i, keys[i])
+		}
+	}
+
+	if keys := intervalKeys(0, 0xffffffff, 4); keys != nil {
+		t.Error("No Pass", keys)
+	}
+	if keys, err := CIDR(0x0a100000, 12).keys(32); err != nil || len(keys) != 16 || len(keys[0]) != 2 {
+		t.Error("No Pass", keys, err)
+	}
+}
+
+func TestEngine_MatchTopK(t *testing.T) {
+	e := newMatchEngine(t)
+
+	// 规则1、2、4都匹配, 1和4优先级相同时id小的优先
+	flow := Flow{SrcIP: uint32(ip(10, 1, 2, 3)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, DstPort: 443}
+	if ret, err := e.Match(flow); err != nil || !equalValues(ret, []uint64{1, 2, 4}) {
+		t.Fatal("No Pass", ret, err)
+	}
+
+	if id, ok, err := e.MatchFirst(flow); err != nil || !ok || id != 1 {
+		t.Error("No Pass", id, ok, err)
+	}
+
+	if ret, err := e.MatchTopK(flow, 2); err != nil || !equalValues(ret, []uint64{1, 4}) {
+		t.Error("No Pass", ret, err)
+	}
+
+	if ret, err := e.MatchTopK(flow, 10); err != nil || !equalValues(ret, []uint64{1, 4, 2}) {
+		t.Error("No Pass", ret, err)
+	}
+
+	if err := e.index.memtable.SetPriority(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := e.MatchFirst(flow); id != 2 {
+		t.Error("No Pass", id)
+	}
+
+	if err := e.index.memtable.SetPriority(100, 1); err == nil {
+		t.Error("No Pass")
+	}
+
+	// Index 在所有属性写入后设置优先级
+	pr := &testPriorityRule{testRule{id: 7, attrs: map[string]int64{"sip": ip(10, 1, 2, 3), "dip": ip(192, 168, 1, 1)}, any: map[string]bool{"svc": true}}, 0}
+	if _, err := e.Index(pr); err != nil || e.index.memtable.priorityOf(7) != 0 {
+		t.Error("No Pass", err)
+	}
+	if id, _, _ := e.MatchFirst(flow); id != 7 {
+		t.Error("No Pass", id)
+	}
+
+	flow.DstPort = 22
+	flow.DstIP = uint32(ip(1, 1, 1, 1))
+	if _, ok, err := e.MatchFirst(flow); err != nil || ok {
+		t.Error("No Pass", ok, err)
+	}
+}
+
+func TestIndexer_TopK(t *testing.T) {
+	indexer, err := Builder().AddAttrItem("port", 16, 0).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		indexer.AddAttrKeyValue("port", int64(i%7), uint64(i))
+		if i%3 != 0 {
+			indexer.SetPriority(uint64(i), i%5-2)
+		}
+	}
+	indexer.SetPriority(999, 0)
+	indexer.Delete(998)
+
+	// 按优先级和id排序得到的期望结果
+	better := func(a, b uint64) bool {
+		pa, pb := indexer.priorityOf(a), indexer.priorityOf(b)
+		return pa < pb || pa == pb && a < b
+	}
+
+	pack, _ := indexer.Filter(trie.In("port", IntXXToBytes(1, 16), IntXXToBytes(3, 16)))
+	all := pack.Unpack()
+	sort.Slice(all, func(i, j int) bool {
+		return better(all[i], all[j])
+	})
+
+	for _, k := range []int{1, 10, 100, len(all), len(all) + 1} {
+		expect := all
+		if k < len(all) {
+			expect = all[:k]
+		}
+
+		if ret := indexer.topKByLevel(pack, k); !equalValues(ret, expect) {
+			t.Error("No Pass", k, ret)
+		}
+		if ret := indexer.topKByHeap(pack, k); !equalValues(ret, expect) {
+			t.Error("No Pass", k, ret)
+		}
+		if ret := indexer.TopK(pack, k); !equalValues(ret, expect) {
+			t.Error("No Pass", k, ret)
+		}
+	}
+}
+
+// BenchmarkAnalyze 随机的CIDR和端口区间规则, 每条规则都有具体的约束;
+// 全部通配的规则以所有value为候选集, 会退化为平方复杂度, 不在这里测量
+func BenchmarkAnalyze(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			analyzer, err := NewIndexerEngine()
+			if err != nil {
+				b.Fatal(err)
+			}
+			e := analyzer.(*engine)
+
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < n; i++ {
+				port := uint16(rnd.Intn(65000))
+				r := &testConstraintRule{uint64(i + 1), map[string]Constraint{
+					"sip": CIDR(uint64(rnd.Uint32()), 16+rnd.Intn(17)),
+					"dip": CIDR(uint64(rnd.Uint32()), 8+rnd.Intn(25)),
+					"svc": Interval(Service(6, port), Service(6, port+uint16(rnd.Intn(500)))),
+				}, rnd.Intn(10)}
+				if err := e.IndexConstraint(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.index.memtable.Analyze()
+			}
+		})
+	}
+}
+
+func TestIndexer_Analyze(t *testing.T) {
+	e := newMatchEngine(t)
+
+	rules := []*testConstraintRule{
+		// 被规则1完全覆盖
+		{5, map[string]Constraint{"sip": CIDR(uint64(ip(10, 1, 0, 0)), 16), "svc": Interval(Service(6, 100), Service(6, 200))}, 20},
+		// 与规则4相同
+		{6, map[string]Constraint{"svc": Interval(Service(6, 443), Service(6, 65535))}, 30},
+	}
+	for _, r := range rules {
+		if err := e.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ret := e.index.memtable.Analyze()
+
+	expect := []struct {
+		pairs  []RulePair
+		expect []RulePair
+	}{
+		{ret.Shadowed, []RulePair{{1, 5}}},
+		{ret.Redundant, []RulePair{{4, 6}}},
+		{ret.Overlapping, []RulePair{{1, 2}, {1, 4}, {1, 6}, {4, 2}, {5, 2}, {6, 2}}},
+	}
+	for i, e := range expect {
+		if len(e.pairs) != len(e.expect) {
+			t.Error("No Pass", i, e.pairs)
+			continue
+		}
+		for j := range e.pairs {
+			if e.pairs[j] != e.expect[j] {
+				t.Error("No Pass", i, e.pairs)
+			}
+		}
+	}
+}
+
+func TestEngine_Overlapping(t *testing.T) {
+	e := newMatchEngine(t)
+
+	r := &testConstraintRule{9, map[string]Constraint{"sip": CIDR(uint64(ip(10, 1, 0, 0)), 16), "svc": Interval(Service(6, 80), Service(6, 8080))}, 0}
+	ret, err := e.Overlapping(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []Overlap{
+		{1, map[string]OverlapKind{"sip": OverlapContained, "dip": OverlapEqual, "svc": OverlapContains}},
+		{2, map[string]OverlapKind{"sip": OverlapContained, "dip": OverlapContains, "svc": OverlapContained}},
+		{4, map[string]OverlapKind{"sip": OverlapContained, "dip": OverlapEqual, "svc": OverlapPartial}},
+	}
+	if len(ret) != len(expect) {
+		t.Fatal("No Pass", ret)
+	}
+	for i := range ret {
+		if ret[i].ID != expect[i].ID {
+			t.Error("No Pass", ret[i])
+			continue
+		}
+		for attr, kind := range expect[i].Attrs {
+			if ret[i].Attrs[attr] != kind {
+				t.Error("No Pass", ret[i].ID, attr, ret[i].Attrs[attr])
+			}
+		}
+	}
+
+	// 不包含规则自身
+	self := &testConstraintRule{1, map[string]Constraint{"sip": CIDR(uint64(ip(10, 0, 0, 0)), 8)}, 0}
+	if ret, err := e.Overlapping(self); err != nil || len(ret) != 3 || ret[0].ID != 2 || ret[2].ID != 4 {
+		t.Error("No Pass", ret, err)
+	}
+
+	bad := &testConstraintRule{9, map[string]Constraint{"sip": CIDR(0, 33)}, 0}
+	if _, err := e.Overlapping(bad); err == nil {
+		t.Error("No Pass")
+	}
+}
+
+type testMultiRule struct {
+	id          uint64
+	constraints map[string][]Constraint
+}
+
+func (r *testMultiRule) ID() uint64 {
+	return r.id
+}
+
+func (r *testMultiRule) Constraints(key string) ([]Constraint, error) {
+	cs, ok := r.constraints[key]
+	if !ok {
+		return nil, ErrAnyAttr
+	}
+
+	return cs, nil
+}
+
+func TestEngine_MultiRule(t *testing.T) {
+	e := newMatchEngine(t)
+	sip := e.index.memtable.attrItems["sip"]
+	keys, values := sip.trie.PrefixCount([]byte{10})
+
+	r := &testMultiRule{7, map[string][]Constraint{
+		"sip": {CIDR(uint64(ip(10, 0, 0, 0)), 8), CIDR(uint64(ip(10, 1, 0, 0)), 16), CIDR(uint64(ip(172, 16, 0, 0)), 12)},
+		"svc": {Value(Service(6, 22)), Interval(Service(6, 8000), Service(6, 8100))},
+	}}
+	if err := e.IndexMulti(r); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := &testMultiRule{8, map[string][]Constraint{"sip": {CIDR(0, 8), CIDR(0, 33)}}}
+	if err := e.IndexMulti(bad); err == nil || e.index.memtable.all.Contains(8) {
+		t.Error("No Pass", err)
+	}
+
+	flows := []Flow{
+		{SrcIP: uint32(ip(10, 1, 2, 3)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, DstPort: 22},
+		{SrcIP: uint32(ip(172, 20, 0, 1)), DstIP: uint32(ip(1, 1, 1, 1)), Proto: 6, DstPort: 8080},
+	}
+	check := func(expect [][]uint64) {
+		for i, flow := range flows {
+			ids, err := e.Match(flow)
+			if err != nil || len(ids) != len(expect[i]) {
+				t.Error("No Pass", i, ids, err)
+				continue
+			}
+			for j := range ids {
+				if ids[j] != expect[i][j] {
+					t.Error("No Pass", i, ids)
+				}
+			}
+		}
+	}
+	check([][]uint64{{2, 7}, {4, 7}})
+
+	r.constraints = map[string][]Constraint{"sip": {CIDR(uint64(ip(192, 168, 0, 0)), 16)}}
+	if err := e.Update(r); err != nil {
+		t.Fatal(err)
+	}
+	check([][]uint64{{2}, {4}})
+
+	if k, v := sip.trie.PrefixCount([]byte{10}); k != keys || v != values {
+		t.Error("No Pass", k, v)
+	}
+
+	if err := e.Delete(7); err != nil || e.index.memtable.all.Contains(7) || e.index.memtable.Delete(7) {
+		t.Error("No Pass", err)
+	}
+	if k, _ := sip.trie.PrefixCount([]byte{192}); k != 0 {
+		t.Error("No Pass", k)
+	}
+
+	// 属性先有具体的key后通配、先通配后有具体的key, 删除后都不留下key
+	query := func(q string) []uint64 {
+		ids, err := e.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	sipRule := &testRule{id: 30, attrs: map[string]int64{"sip": ip(1, 2, 3, 4), "dip": ip(5, 6, 7, 8), "svc": 1}}
+	if _, err := e.Index(sipRule); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.IndexConstraint(&testConstraintRule{id: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := sip.trie.PrefixCount([]byte{1, 2, 3, 4}); k != 0 || !sip.any.Contains(30) {
+		t.Error("No Pass", k)
+	}
+	if _, err := e.Index(sipRule); err != nil {
+		t.Fatal(err)
+	}
+	// 规则2、4在sip上通配
+	if ids := query("sip = 1.2.3.4"); !equalValues(ids, []uint64{2, 4, 30}) {
+		t.Error("No Pass", ids)
+	}
+	if err := e.Delete(30); err != nil {
+		t.Fatal(err)
+	}
+	if ids := query("sip = 1.2.3.4"); !equalValues(ids, []uint64{2, 4}) {
+		t.Error("No Pass", ids)
+	}
+	if k, _ := sip.trie.PrefixCount([]byte{1}); k != 0 {
+		t.Error("No Pass", k)
+	}
+}
+
+func TestEngine_Not(t *testing.T) {
+	e := newMatchEngine(t)
+
+	excluded := []Constraint{Not(CIDR(uint64(ip(10, 0, 0, 0)), 8)), Not(CIDR(uint64(ip(172, 16, 0, 0)), 12))}
+	if err := e.IndexMulti(&testMultiRule{8, map[string][]Constraint{"dip": excluded}}); err != nil {
+		t.Fatal(err)
+	}
+	r := &testConstraintRule{9, map[string]Constraint{"sip": Not(CIDR(uint64(ip(192, 168, 0, 0)), 16)), "dip": Value(uint64(ip(10, 1, 1, 1)))}, 0}
+	if err := e.IndexConstraint(r); err != nil {
+		t.Fatal(err)
+	}
+
+	bads := []*testMultiRule{
+		{10, map[string][]Constraint{"dip": {Not(Any())}}},
+		{10, map[string][]Constraint{"dip": {Not(CIDR(0, 0))}}},
+		{10, map[string][]Constraint{"dip": {Not(Value(1)), Value(2)}}},
+	}
+	for i, bad := range bads {
+		if err := e.IndexMulti(bad); err == nil || e.index.memtable.all.Contains(10) {
+			t.Error("No Pass", i, err)
+		}
+	}
+
+	cases := []struct {
+		flow   Flow
+		expect []uint64
+	}{
+		{Flow{SrcIP: uint32(ip(10, 1, 2, 3)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, DstPort: 443}, []uint64{1, 2, 4, 8}},
+		{Flow{SrcIP: uint32(ip(10, 1, 2, 3)), DstIP: uint32(ip(10, 1, 1, 1)), Proto: 6, DstPort: 443}, []uint64{1, 4, 9}},
+		{Flow{SrcIP: uint32(ip(192, 168, 5, 5)), DstIP: uint32(ip(10, 1, 1, 1)), Proto: 6, DstPort: 22}, nil},
+	}
+	for i, c := range cases {
+		ids, err := e.Match(c.flow)
+		if err != nil || len(ids) != len(c.expect) {
+			t.Error("No Pass", i, ids, err)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != c.expect[j] {
+				t.Error("No Pass", i, ids)
+			}
+		}
+	}
+
+	// 按点查和逐个过滤的结果一致
+	f := trie.Eq("dip", IntXXToBytes(ip(10, 1, 1, 1), 32))
+	pack, err := e.index.memtable.Filter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := pack.Unpack(); len(ids) != 3 || ids[0] != 1 || ids[1] != 4 || ids[2] != 9 {
+		t.Error("No Pass", ids)
+	}
+	if n := e.index.memtable.filterValues(e.index.memtable.all, f).Count(); n != 3 {
+		t.Error("No Pass", n)
+	}
+
+	// 排除集合覆盖整个范围时不返回取反的规则, 按范围查找和逐个过滤的结果一致
+	ranges := []struct {
+		query  string
+		expect []uint64
+	}{
+		{"dip = 10.1.0.0/16", []uint64{1, 4, 9}},
+		{"dip >= 10.1.0.0 AND dip <= 10.2.0.0", []uint64{1, 4, 9}},
+		{"dip >= 172.16.0.0 AND dip <= 172.31.255.255", []uint64{1, 4}},
+		{"dip >= 10.255.0.0 AND dip <= 11.0.0.0", []uint64{1, 4, 8}},
+		{"dip = 0.0.0.0/0", []uint64{1, 2, 3, 4, 8, 9}},
+		{"dip >= 10.2.0.0 AND svc >= 0 AND dip <= 10.1.0.0", nil},
+	}
+	for _, c := range ranges {
+		ids, err := e.Query(c.query)
+		if err != nil || !equalValues(ids, c.expect) {
+			t.Error("No Pass", c.query, ids, err)
+		}
+
+		f, err := e.index.memtable.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := e.index.memtable.filterValues(e.index.memtable.all, f).Unpack(); !equalValues(ids, c.expect) {
+			t.Error("No Pass", c.query, ids)
+		}
+	}
+
+	ret, err := e.Overlapping(&testConstraintRule{11, map[string]Constraint{"dip": Not(CIDR(uint64(ip(10, 0, 0, 0)), 8))}, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[uint64]OverlapKind)
+	for _, o := range ret {
+		kinds[o.ID] = o.Attrs["dip"]
+	}
+	if _, ok := kinds[9]; ok || kinds[8] != OverlapContains || kinds[2] != OverlapContains || kinds[1] != OverlapContained {
+		t.Error("No Pass", ret)
+	}
+
+	if err := e.Delete(8); err != nil || e.index.memtable.attrItems["dip"].not.Count() != 0 {
+		t.Error("No Pass", err)
+	}
+	if k, _ := e.index.memtable.attrItems["dip"].notTrie.PrefixCount([]byte{10}); k != 0 {
+		t.Error("No Pass", k)
+	}
+}
+
+func TestIndexer_String(t *testing.T) {
+	indexer, err := Builder().
+		AddStringAttrItem("host", 0, true).
+		AddStringAttrItem("user", 0, false).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []struct {
+		host, user string
+	}{
+		{"web-01", "alice"},
+		{"Web-02", "bob"},
+		{"db-01", "Carol"},
+		{"web", "alice"},
+		{"web-01.example", "dave"},
+		// 与规则4相同
+		{"WEB", "alice"},
+	}
+	for i, r := range rules {
+		if err := indexer.AddAttrString("host", r.host, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := indexer.AddAttrString("user", r.user, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query  string
+		expect []uint64
+	}{
+		{`host = "WEB-01"`, []uint64{1}},
+		{`host PREFIX "web"`, []uint64{1, 2, 4, 5, 6}},
+		{`host prefix "Web-0"`, []uint64{1, 2, 5}},
+		{`user = "carol"`, nil},
+		{`user = "Carol"`, []uint64{3}},
+		{`user >= "alice" AND user < "carol"`, []uint64{1, 2, 4, 6}},
+		{`user > "alice"`, []uint64{2, 5}},
+		{`host IN ["db-01", "web"]`, []uint64{3, 4, 6}},
+		{`host <= "web-01"`, []uint64{1, 3, 4, 6}},
+		{`host != "web" AND user = "alice"`, []uint64{1}},
+		{`host = "a\"b"`, nil},
+		{`host ~ "^web-[0-9]+$"`, []uint64{1, 2}},
+		{`host ~ "EXAMPLE$" OR user ~ "^[A-Z]"`, []uint64{3, 5}},
+		{`host ~ "\\."`, []uint64{5}},
+	}
+	for _, c := range cases {
+		f, err := indexer.ParseQuery(c.query)
+		if err != nil {
+			t.Error("No Pass", c.query, err)
+			continue
+		}
+
+		pack, err := indexer.Filter(f)
+		if err != nil {
+			t.Error("No Pass", c.query, err)
+			continue
+		}
+
+		ids := pack.Unpack()
+		if len(ids) != len(c.expect) {
+			t.Error("No Pass", c.query, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != c.expect[i] {
+				t.Error("No Pass", c.query, ids)
+			}
+		}
+
+		if n := indexer.filterValues(indexer.all, f).Count(); n != len(c.expect) {
+			t.Error("No Pass", c.query, n)
+		}
+	}
+
+	for _, query := range []string{`host = 1`, `host = "web`, `user = ""`, `host IN [1]`, `host ~ "("`, `host ~ web`} {
+		if _, err := indexer.ParseQuery(query); err == nil {
+			t.Error("No Pass", query)
+		}
+	}
+
+	matches, err := indexer.FuzzySearch("host", "WEB-0", 1, 0)
+	if err != nil || len(matches) != 2 || string(matches[0].Key) != "web-01" || string(matches[1].Key) != "web-02" {
+		t.Error("No Pass", matches, err)
+	}
+	if matches, err := indexer.FuzzySearch("host", "web-0", 1, 1); err != nil || len(matches) != 1 || !matches[0].Values.Contains(1) {
+		t.Error("No Pass", matches, err)
+	}
+
+	if err := indexer.AddAttrKeyValue("host", 1, 7); err == nil {
+		t.Error("No Pass")
+	}
+	if err := indexer.AddAttrString("host", "", 7); err == nil {
+		t.Error("No Pass")
+	}
+
+	ret := indexer.Analyze()
+	if len(ret.Redundant) != 1 || ret.Redundant[0] != (RulePair{4, 6}) || len(ret.Shadowed) != 0 || len(ret.Overlapping) != 0 {
+		t.Error("No Pass", ret)
+	}
+
+	// 字符串不再被使用时删除编号, 新字符串的编号不与已有的重复
+	host := indexer.attrItems["host"]
+	indexer.Delete(4)
+	if _, ok := host.ids["web"]; !ok {
+		t.Error("No Pass")
+	}
+	indexer.Delete(6)
+	if _, ok := host.ids["web"]; ok || len(host.ids) != 4 {
+		t.Error("No Pass", host.ids)
+	}
+	indexer.AddAttrString("host", "cache-01", 7)
+	seen := make(map[uint64]bool)
+	for _, id := range host.ids {
+		if seen[id] {
+			t.Error("No Pass", host.ids)
+		}
+		seen[id] = true
+	}
+}
+
+func TestEngine_Ternary(t *testing.T) {
+	e := newMatchEngine(t)
+
+	rules := []*testConstraintRule{
+		// 任意协议的 80-95 端口
+		{10, map[string]Constraint{"svc": Ternary(Service(0, 0x0050), 0xff00fff0)}, 0},
+		// 10.*.2.1, 连续高位的mask等同于CIDR
+		{11, map[string]Constraint{"sip": Ternary(uint64(ip(10, 0, 2, 1)), 0xff00ffff), "dip": Ternary(uint64(ip(192, 168, 1, 0)), 0xffffff00)}, 0},
+	}
+	for _, r := range rules {
+		if err := e.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// udp 53 或任意协议的 8080-8095 端口
+	if err := e.IndexMulti(&testMultiRule{12, map[string][]Constraint{"svc": {Value(Service(17, 53)), Ternary(Service(0, 0x1f90), 0xff00fff0)}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.index.memtable.attrItems["dip"].ternaryValues.Contains(11) || !e.index.memtable.attrItems["sip"].ternaryValues.Contains(11) {
+		t.Error("No Pass")
+	}
+	if err := e.IndexConstraint(&testConstraintRule{15, map[string]Constraint{"svc": Not(Ternary(1, 0xf0f))}, 0}); err == nil {
+		t.Error("No Pass")
+	}
+
+	flows := []Flow{
+		{SrcIP: uint32(ip(10, 1, 2, 1)), DstIP: uint32(ip(192, 168, 1, 7)), Proto: 6, DstPort: 85},
+		{SrcIP: uint32(ip(10, 1, 2, 2)), DstIP: uint32(ip(8, 8, 8, 8)), Proto: 6, DstPort: 8085},
+		{SrcIP: uint32(ip(10, 1, 2, 1)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 17, DstPort: 53},
+	}
+	check := func(expect [][]uint64) {
+		for i, flow := range flows {
+			ids, err := e.Match(flow)
+			if err != nil || fmt.Sprint(ids) != fmt.Sprint(expect[i]) {
+				t.Error("No Pass", i, ids, err)
+			}
+		}
+	}
+	check([][]uint64{{1, 2, 10, 11}, {4, 12}, {2, 3, 11, 12}})
+
+	// 按点查和逐个过滤的结果一致
+	f := trie.Eq("svc", IntXXToBytes(int64(Service(6, 85)), 32))
+	pack, err := e.index.memtable.Filter(f)
+	if err != nil || fmt.Sprint(pack.Unpack()) != "[1 2 10 11]" {
+		t.Error("No Pass", pack, err)
+	}
+	if n := e.index.memtable.filterValues(e.index.memtable.all, f).Count(); n != 4 {
+		t.Error("No Pass", n)
+	}
+
+	// 范围中没有满足三态约束的取值时不返回三态的规则, 按范围查找和逐个过滤的结果一致
+	ranges := []struct {
+		query  string
+		expect []uint64
+	}{
+		{"svc >= 1000 AND svc <= 2000", []uint64{2, 11}},
+		{"svc >= 0x6005f AND svc <= 0x60060", []uint64{1, 2, 10, 11}},
+		{"svc > 0x1105f AND svc < 0x11f90", []uint64{2, 11}},
+		{"svc >= 0x11f9f AND svc <= 0x11fa0", []uint64{2, 11, 12}},
+	}
+	for _, c := range ranges {
+		ids, err := e.Query(c.query)
+		if err != nil || !equalValues(ids, c.expect) {
+			t.Error("No Pass", c.query, ids, err)
+		}
+
+		f, err := e.index.memtable.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := e.index.memtable.filterValues(e.index.memtable.all, f).Unpack(); !equalValues(ids, c.expect) {
+			t.Error("No Pass", c.query, ids)
+		}
+	}
+
+	ret, err := e.Overlapping(&testConstraintRule{16, map[string]Constraint{"svc": Ternary(Service(0, 0x0050), 0xff00fff0)}, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[uint64]OverlapKind)
+	for _, o := range ret {
+		kinds[o.ID] = o.Attrs["svc"]
+	}
+	if _, ok := kinds[12]; ok || kinds[10] != OverlapEqual || kinds[1] != OverlapPartial {
+		t.Error("No Pass", ret)
+	}
+
+	more := []*testConstraintRule{
+		// 任意协议的 80-87 端口, 被规则10覆盖
+		{13, map[string]Constraint{"svc": Ternary(Service(0, 0x0050), 0xff00fff8)}, 5},
+		{14, map[string]Constraint{"svc": Ternary(0, 0x00aaaaaa)}, 0},
+	}
+	for _, r := range more {
+		if err := e.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	analysis := e.index.memtable.Analyze()
+	if fmt.Sprint(analysis.Skipped) != "[14]" {
+		t.Error("No Pass", analysis.Skipped)
+	}
+	shadowed := false
+	for _, pair := range analysis.Shadowed {
+		shadowed = shadowed || pair == RulePair{10, 13}
+	}
+	if !shadowed {
+		t.Error("No Pass", analysis.Shadowed)
+	}
+
+	if err := e.Delete(10); err != nil || e.index.memtable.attrItems["svc"].ternaryValues.Contains(10) {
+		t.Error("No Pass", err)
+	}
+	if err := e.Delete(13); err != nil {
+		t.Error("No Pass", err)
+	}
+	check([][]uint64{{1, 2, 11}, {4, 12}, {2, 3, 11, 12}})
+}
+
+func TestTimeIndex(t *testing.T) {
+	build := func() (*Indexer, error) {
+		return Builder().AddTimeAttrItem("ts", 0).AddAttrItem("sip", 32, 0).Build()
+	}
+
+	ti, err := NewTimeIndex("ts", 5*time.Minute, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每分钟一条记录, 最新的一条为value 1
+	now := time.Now()
+	times := make(map[uint64]time.Time)
+	for i := 0; i < 60; i++ {
+		value := uint64(i + 1)
+		times[value] = now.Add(-time.Duration(i) * time.Minute)
+
+		err := ti.Add(times[value], value, func(indexer *Indexer) error {
+			return indexer.AddAttrKeyValue("sip", int64(i%4), value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ti.Buckets(); n < 12 || n > 13 {
+		t.Error("No Pass", n)
+	}
+
+	expect := func(from, to time.Time, sip int64) string {
+		var ids []uint64
+		for value := uint64(1); value <= 60; value++ {
+			tm, ok := times[value]
+			if !ok || tm.Before(from) || tm.After(to) || (sip >= 0 && int64(value-1)%4 != sip) {
+				continue
+			}
+			ids = append(ids, value)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	from, to := now.Add(-15*time.Minute), now
+	pack, err := ti.Search(from, to, nil)
+	if err != nil || fmt.Sprint(pack.Unpack()) != expect(from, to, -1) {
+		t.Error("No Pass", pack.Unpack(), err)
+	}
+
+	sip := trie.Eq("sip", IntXXToBytes(1, 32))
+	pack, err = ti.Search(from, to, sip)
+	if err != nil || fmt.Sprint(pack.Unpack()) != expect(from, to, 1) {
+		t.Error("No Pass", pack.Unpack(), err)
+	}
+
+	// now之后才写入的记录不会出现, 最近15分钟不包含value 16
+	pack, err = ti.SearchLast(15*time.Minute, nil)
+	if err != nil || pack.Count() != 15 || pack.Contains(16) {
+		t.Error("No Pass", pack.Unpack(), err)
+	}
+
+	// 丢弃30分钟之前结束的桶, 更早的记录不再出现
+	before := now.Add(-30 * time.Minute)
+	dropped := ti.Expire(before)
+	if dropped == 0 || dropped+ti.Buckets() < 12 {
+		t.Error("No Pass", dropped, ti.Buckets())
+	}
+	for value, tm := range times {
+		if tm.Truncate(5 * time.Minute).Add(5 * time.Minute).After(before) {
+			continue
+		}
+		delete(times, value)
+	}
+	from = now.Add(-time.Hour)
+	pack, err = ti.Search(from, to, nil)
+	if err != nil || fmt.Sprint(pack.Unpack()) != expect(from, to, -1) || pack.Contains(60) {
+		t.Error("No Pass", pack.Unpack(), err)
+	}
+
+	// 1970年之前的时间也保持顺序
+	old := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	if string(EncodeTime(old)) >= string(EncodeTime(time.Unix(0, 0))) ||
+		string(EncodeTime(time.Unix(0, 0))) >= string(EncodeTime(now)) {
+		t.Error("No Pass")
+	}
+
+	indexer, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := indexer.AddAttrTime("ts", base.Add(time.Duration(i-1)*time.Minute), uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		query  string
+		expect string
+	}{
+		{`ts >= "2026-10-19T10:00:00Z"`, "[2 3 4]"},
+		{`ts < "2026-10-19T10:00:00Z"`, "[1]"},
+		{`ts = "2026-10-19T18:01:00+08:00"`, "[3]"},
+		{`ts IN ["2026-10-19T09:59:00Z", "2026-10-19T10:02:00Z"]`, "[1 4]"},
+	}
+	for _, c := range cases {
+		f, err := indexer.ParseQuery(c.query)
+		if err != nil {
+			t.Error("No Pass", c.query, err)
+			continue
+		}
+
+		pack, err := indexer.Filter(f)
+		if err != nil || fmt.Sprint(pack.Unpack()) != c.expect {
+			t.Error("No Pass", c.query, err)
+		}
+	}
+
+	for _, query := range []string{`ts = 1`, `ts = "2026-10-19"`} {
+		if _, err := indexer.ParseQuery(query); err == nil {
+			t.Error("No Pass", query)
+		}
+	}
+
+	if err := indexer.AddAttrTime("sip", base, 7); err == nil {
+		t.Error("No Pass")
+	}
+	if _, err := NewTimeIndex("sip", time.Minute, build); err == nil {
+		t.Error("No Pass")
+	}
+
+	// 时间属性只能按 EncodeTime 编码写入
+	if err := indexer.AddAttrKeyValue("ts", 1, 7); err == nil {
+		t.Error("No Pass")
+	}
+	if err := indexer.AddAttrConstraints("ts", []Constraint{Value(1)}, 7); err == nil {
+		t.Error("No Pass")
+	}
+
+	// 写入其他属性失败时不留下只有时间的记录
+	err = ti.Add(now, 100, func(indexer *Indexer) error {
+		return indexer.AddAttrKeyValue("dip", 1, 100)
+	})
+	if err == nil {
+		t.Error("No Pass")
+	}
+	if pack, err := ti.SearchLast(time.Minute, nil); err != nil || pack.Contains(100) {
+		t.Error("No Pass", pack.Unpack(), err)
+	}
+
+	// 写入、查询和丢弃过期的桶可以并发执行
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				value := uint64(1000 + w*100 + i)
+				if err := ti.Add(base.Add(time.Duration(i)*time.Minute), value, nil); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+				if _, err := ti.Search(base, base.Add(time.Hour), nil); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+				ti.Expire(base.Add(time.Duration(i-30) * time.Minute))
+				ti.Buckets()
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestSegmentedIndex(t *testing.T) {
+	build := func() (*Indexer, error) {
+		return Builder().AddAttrItem("sip", 32, 0).AddAttrItem("svc", 32, 0).Build()
+	}
+
+	// 只设置墓碑比例时不限制段的数量
+	ratio := &TieredPolicy{DeletedRatio: 0.3}
+	if ret := ratio.Select([]SegmentInfo{{Values: 10}, {Values: 10, Deleted: 2}}); len(ret) != 0 {
+		t.Error("No Pass", ret)
+	}
+	if ret := ratio.Select([]SegmentInfo{{Values: 10}, {Values: 10, Deleted: 4}}); fmt.Sprint(ret) != "[1]" {
+		t.Error("No Pass", ret)
+	}
+
+	si, err := NewSegmentedIndex(build, 16, &TieredPolicy{MaxSegments: 2, DeletedRatio: 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 未分段的索引作为对照
+	ref, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(value uint64, version int) {
+		sip := []Constraint{CIDR(0x0a000000|uint64(value%8)<<8, 24)}
+		svc := []Constraint{Value(uint64(version*100) + value%5)}
+		switch value % 7 {
+		case 0:
+			svc = []Constraint{Any()}
+		case 1:
+			sip = []Constraint{Not(CIDR(0x0a000000, 24))}
+		}
+
+		fn := func(indexer *Indexer) error {
+			if err := indexer.AddAttrConstraints("sip", sip, value); err != nil {
+				return err
+			}
+			if err := indexer.AddAttrConstraints("svc", svc, value); err != nil {
+				return err
+			}
+			return indexer.SetPriority(value, version)
+		}
+
+		if err := si.Put(value, fn); err != nil {
+			t.Fatal(err)
+		}
+		ref.Delete(value)
+		if err := fn(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := []string{
+		"sip = 10.0.3.0/24",
+		"sip = 10.0.0.1 AND svc = 2",
+		"svc >= 100",
+		"NOT sip = 10.0.1.0/24 OR svc = 4",
+	}
+	check := func(step string) {
+		for _, query := range queries {
+			pack, err := si.Query(query)
+			if err != nil {
+				t.Fatal(step, query, err)
+			}
+			f, err := ref.ParseQuery(query)
+			if err != nil {
+				t.Fatal(step, query, err)
+			}
+			expect, err := ref.Filter(f)
+			if err != nil {
+				t.Fatal(step, query, err)
+			}
+			if fmt.Sprint(pack.Unpack()) != fmt.Sprint(expect.Unpack()) {
+				t.Error("No Pass", step, query, pack.Unpack(), expect.Unpack())
+			}
+		}
+
+		for sip := uint64(0); sip < 8; sip++ {
+			values := map[string]uint64{"sip": 0x0a000001 | sip<<8, "svc": 103}
+			pack, err := si.Match(values)
+			if err != nil {
+				t.Fatal(step, err)
+			}
+			expect, err := ref.Match(values)
+			if err != nil {
+				t.Fatal(step, err)
+			}
+			if fmt.Sprint(pack.Unpack()) != fmt.Sprint(expect.Unpack()) {
+				t.Error("No Pass", step, values, pack.Unpack(), expect.Unpack())
+			}
+		}
+	}
+
+	for value := uint64(1); value <= 70; value++ {
+		put(value, 0)
+	}
+	if n := len(si.Segments()); n != 4 {
+		t.Error("No Pass", n)
+	}
+	check("put")
+
+	// 更新和删除在旧的段中记录墓碑
+	for value := uint64(1); value <= 70; value += 3 {
+		put(value, 1)
+	}
+	for value := uint64(2); value <= 70; value += 5 {
+		if !si.Delete(value) || !ref.Delete(value) {
+			t.Error("No Pass", value)
+		}
+	}
+	if si.Delete(1000) {
+		t.Error("No Pass")
+	}
+	check("update")
+
+	for {
+		n, err := si.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		check("compact")
+	}
+	for _, s := range si.Segments() {
+		if float64(s.Deleted) > 0.3*float64(s.Values) {
+			t.Error("No Pass", s)
+		}
+	}
+	if n := len(si.Segments()); n > 2 {
+		t.Error("No Pass", n)
+	}
+
+	// 后台合并与写入并发执行
+	if err := si.StartCompactor(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.StartCompactor(time.Millisecond); err == nil {
+		t.Error("No Pass")
+	}
+	for value := uint64(71); value <= 200; value++ {
+		put(value, 2)
+		if value%10 == 0 {
+			si.Delete(value - 50)
+			ref.Delete(value - 50)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	si.StopCompactor()
+	si.StopCompactor()
+	check("compactor")
+
+	if err := si.Put(1, func(indexer *Indexer) error {
+		return indexer.AddAttrKeyValue("dip", 1, 1)
+	}); err == nil {
+		t.Error("No Pass")
+	}
+	check("failed put")
+
+	// memtable中的旧版本在写入部分属性后失败时恢复
+	put(201, 3)
+	if _, ok := si.memtable.metadataTable[201]; !ok {
+		t.Fatal("No Pass")
+	}
+	if err := si.Put(201, func(indexer *Indexer) error {
+		if err := indexer.AddAttrConstraint("sip", CIDR(0x0b000000, 8), 201); err != nil {
+			return err
+		}
+		return errors.New("failed")
+	}); err == nil {
+		t.Error("No Pass")
+	}
+	if md := si.memtable.metadataTable[201]; md == nil || md.priority != 3 || si.spare.all.Size() != 0 {
+		t.Error("No Pass")
+	}
+	check("failed update")
+}
+
+func TestEngine_Segments(t *testing.T) {
+	// memtable很小的引擎数据分布在多个段中, 结果与只有memtable的引擎相同
+	e, err := newIndexerEngine(8, &TieredPolicy{MaxSegments: 2, DeletedRatio: 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := newIndexerEngine(engineMemtableSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := func(id uint64, priority int) {
+		r := &testConstraintRule{id: id, priority: priority, constraints: map[string]Constraint{
+			"sip": CIDR(uint64(ip(10, byte(id%4), 0, 0)), 16),
+			"dip": Value(uint64(ip(192, 168, 1, byte(id%8)))),
+			"svc": Interval(Service(6, uint16(id%50)), Service(6, uint16(id%50+20))),
+		}}
+		if id%5 == 0 {
+			delete(r.constraints, "dip")
+		}
+		if err := e.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := ref.IndexConstraint(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var flows []Flow
+	for x := byte(0); x < 4; x++ {
+		for y := byte(0); y < 8; y += 3 {
+			for _, port := range []uint16{5, 30, 60} {
+				flows = append(flows, Flow{SrcIP: uint32(ip(10, x, 0, 1)), DstIP: uint32(ip(192, 168, 1, y)), Proto: 6, DstPort: port})
+			}
+		}
+	}
+	queries := []string{
+		"sip = 10.1.0.0/16",
+		"sip = 10.2.0.0/16 AND NOT dip = 192.168.1.2",
+		"dip IN [192.168.1.1, 192.168.1.5] OR svc >= 0x60030",
+	}
+	overlap := &testConstraintRule{id: 1, constraints: map[string]Constraint{"sip": CIDR(uint64(ip(10, 1, 0, 0)), 24)}}
+
+	check := func(step string) {
+		for _, query := range queries {
+			ret, err := e.Query(query)
+			expect, _ := ref.Query(query)
+			if err != nil || fmt.Sprint(ret) != fmt.Sprint(expect) {
+				t.Error("No Pass", step, query, ret, expect, err)
+			}
+
+			explain, err := e.Explain(&querySearch{filter: mustParse(t, e, query)})
+			if err != nil || explain.Actual != len(expect) {
+				t.Error("No Pass", step, query, explain, err)
+			}
+		}
+
+		for _, flow := range flows {
+			ret, err := e.Match(flow)
+			expect, _ := ref.Match(flow)
+			if err != nil || fmt.Sprint(ret) != fmt.Sprint(expect) {
+				t.Error("No Pass", step, flow, ret, expect, err)
+			}
+
+			ret, err = e.MatchTopK(flow, 3)
+			expect, _ = ref.MatchTopK(flow, 3)
+			if err != nil || fmt.Sprint(ret) != fmt.Sprint(expect) {
+				t.Error("No Pass", step, flow, ret, expect, err)
+			}
+		}
+
+		ret, err := e.MatchBatch(flows)
+		expect, _ := ref.MatchBatch(flows)
+		if err != nil || fmt.Sprint(ret) != fmt.Sprint(expect) {
+			t.Error("No Pass", step, err)
+		}
+
+		overlaps, err := e.Overlapping(overlap)
+		expectOverlaps, _ := ref.Overlapping(overlap)
+		if err != nil || fmt.Sprint(overlaps) != fmt.Sprint(expectOverlaps) {
+			t.Error("No Pass", step, overlaps, expectOverlaps, err)
+		}
+	}
+
+	for id := uint64(1); id <= 120; id++ {
+		index(id, int(id%7))
+	}
+	if n := len(e.index.Segments()); n < 10 {
+		t.Error("No Pass", n)
+	}
+	check("index")
+
+	// 删除和替换在旧的段中记录墓碑
+	for id := uint64(3); id <= 120; id += 9 {
+		if err := e.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := ref.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(4); id <= 120; id += 4 {
+		index(id, int(id%3))
+	}
+	check("update")
+
+	// 后台合并与写入并发执行, 不改变查询结果
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(); err == nil {
+		t.Error("No Pass")
+	}
+	for id := uint64(121); id <= 200; id++ {
+		index(id, int(id%5))
+		if _, err := e.index.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Stop()
+	for {
+		n, err := e.index.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	check("compact")
+	if n := len(e.index.Segments()); n > 2 {
+		t.Error("No Pass", n)
+	}
+}
+
+func mustParse(t *testing.T, e *engine, query string) trie.Filter {
+	f, err := e.schema.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestEngine_ResultCache(t *testing.T) {
+	e := newTestEngine(t)
+	cache := NewResultCache(4)
+	e.SetResultCache(cache)
+
+	key := func(v int64) []byte {
+		return IntXXToBytes(v, 32)
+	}
+
+	sip := &testSearch{filter: trie.CIDR("sip", key(ip(10, 0, 0, 0)), 8)}
+	svc := &testSearch{attrs: map[string]uint64{"svc": 22}}
+	search := func(s SearchRule, expect string) {
+		ret, err := e.Search(s)
+		if err != nil || fmt.Sprint(ret) != expect {
+			t.Error("No Pass", s.Filter(), ret, err)
+		}
+	}
+
+	search(sip, "[1 2 4]")
+	search(sip, "[1 2 4]")
+	search(svc, "[1]")
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Error("No Pass", stats)
+	}
+
+	// 子表达式的顺序和嵌套不影响缓存的key
+	a, b, c := trie.Eq("svc", key(22)), trie.Prefix("dip", []byte{192}), trie.Eq("sip", key(ip(10, 0, 0, 1)))
+	if FilterKey(trie.And(a, trie.And(b, c))) != FilterKey(trie.And(c, b, a, b)) ||
+		FilterKey(trie.And(a)) != FilterKey(a) || FilterKey(trie.And()) == FilterKey(trie.Or()) ||
+		FilterKey(trie.And(a, b)) == FilterKey(trie.Or(a, b)) {
+		t.Error("No Pass")
+	}
+	search(&testSearch{filter: trie.Or(a, b)}, "[1 2 3]")
+	search(&testSearch{filter: trie.Or(b, a)}, "[1 2 3]")
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Entries != 3 {
+		t.Error("No Pass", stats)
+	}
+
+	// 与缓存的查询不相交的写入不淘汰结果
+	if _, err := e.Index(&testRule{id: 5, attrs: map[string]int64{"sip": ip(11, 0, 0, 9), "dip": ip(1, 1, 1, 1), "svc": 8080}}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Invalidations != 0 || stats.Entries != 3 {
+		t.Error("No Pass", stats)
+	}
+	search(sip, "[1 2 4]")
+
+	if _, err := e.Index(&testRule{id: 6, attrs: map[string]int64{"sip": ip(10, 9, 0, 1), "dip": ip(1, 1, 1, 1), "svc": 9999}}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Invalidations != 1 || stats.Entries != 2 {
+		t.Error("No Pass", stats)
+	}
+	search(sip, "[1 2 4 6]")
+	search(svc, "[1]")
+
+	// 按前缀存储的约束与查询的key相交, dip 通配时依赖dip的查询也被淘汰, 查询sip的结果保留
+	before := cache.Stats()
+	err := e.IndexConstraint(&testConstraintRule{id: 7, constraints: map[string]Constraint{
+		"sip": CIDR(uint64(ip(172, 16, 0, 0)), 12),
+		"dip": Any(),
+		"svc": Interval(20, 30),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Invalidations != before.Invalidations+2 {
+		t.Error("No Pass", stats)
+	}
+	search(svc, "[1 7]")
+	search(sip, "[1 2 4 6]")
+
+	// 取反的查询依赖所有value
+	not := &testSearch{filter: trie.Not(trie.Eq("svc", key(22)))}
+	search(not, "[2 3 4 5 6]")
+	if err := e.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	search(not, "[2 3 4 5 6]")
+	search(svc, "[7]")
+	search(sip, "[2 4 6]")
+
+	// 超过容量时淘汰最久没有使用的结果
+	before = cache.Stats()
+	for i := int64(1); i <= 3; i++ {
+		search(&testSearch{attrs: map[string]uint64{"svc": uint64(1000 + i)}}, "[]")
+	}
+	if stats := cache.Stats(); stats.Evictions != before.Evictions+uint64(before.Entries+3-4) || stats.Entries != 4 {
+		t.Error("No Pass", before, stats)
+	}
+
+	cache.Purge()
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Error("No Pass", stats)
+	}
+
+	// 不同种类的谓词即使显示相同也不共用缓存的结果
+	in, between := trie.In("svc", key(22), key(443)), trie.Range("svc", key(22), key(443))
+	if FilterKey(in) == FilterKey(between) ||
+		FilterKey(trie.Range("svc", nil, key(22))) == FilterKey(trie.Range("svc", []byte{}, key(22))) {
+		t.Error("No Pass", FilterKey(in), FilterKey(between))
+	}
+	search(&testSearch{filter: in}, "[2 7]")
+	search(&testSearch{filter: between}, "[2 3 4 7]")
+}
+
+func TestEngine_Context(t *testing.T) {
+	e := newTestEngine(t)
+	cache := NewResultCache(4)
+	e.SetResultCache(cache)
+
+	key := func(v int64) []byte {
+		return IntXXToBytes(v, 32)
+	}
+	search := &testSearch{filter: trie.Or(
+		trie.Range("svc", key(80), key(443)),
+		trie.Not(trie.CIDR("sip", key(ip(10, 0, 0, 0)), 8)),
+	)}
+	flow := Flow{SrcIP: uint32(ip(10, 0, 0, 1)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, DstPort: 22}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ret, err := e.SearchContext(canceled, search); err != context.Canceled || ret != nil {
+		t.Error("No Pass", ret, err)
+	}
+	if ret, err := e.MatchContext(canceled, flow); err != context.Canceled || ret != nil {
+		t.Error("No Pass", ret, err)
+	}
+	// 被取消的查询不写入缓存
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Error("No Pass", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if ret, err := e.SearchContext(ctx, search); err != nil || fmt.Sprint(ret) != "[2 3]" {
+		t.Error("No Pass", ret, err)
+	}
+
+	// 大量key的范围查询在遍历trie的过程中超时
+	indexer, err := Builder().AddAttrItem("svc", 32, 0).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1<<14; i++ {
+		if err := indexer.AddAttrKeyValue("svc", i*7, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	f := trie.Range("svc", key(0), key(1<<20))
+	if _, err := indexer.FilterContext(expired, f); err != context.DeadlineExceeded {
+		t.Error("No Pass", err)
+	}
+	if pack, err := indexer.FilterContext(context.Background(), f); err != nil || pack.Count() != 1<<14 {
+		t.Error("No Pass", err)
+	}
+	if _, err := indexer.MatchContext(expired, map[string]uint64{"svc": 7}); err != context.DeadlineExceeded {
+		t.Error("No Pass", err)
+	}
+}
+
+func TestEngine_SearchPage(t *testing.T) {
+	e := newTestEngine(t)
+	for id := uint64(10); id < 200; id++ {
+		r := &testRule{id: id, attrs: map[string]int64{"sip": ip(10, 3, byte(id), 1), "dip": ip(1, 1, 1, 1), "svc": int64(id % 3)}}
+		if _, err := e.Index(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := &testSearch{filter: trie.CIDR("sip", IntXXToBytes(ip(10, 0, 0, 0), 32), 8)}
+	expect, err := e.Search(search)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 翻页期间的写入不影响后续的页
+	var (
+		ids    []uint64
+		cursor string
+		pages  int
+	)
+	for {
+		page, err := e.SearchPage(search, 7, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.IDs) > 7 {
+			t.Error("No Pass", page.IDs)
+		}
+		ids = append(ids, page.IDs...)
+		pages++
+
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+
+		if err := e.Delete(uint64(10 + pages)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Index(&testRule{id: uint64(1000 + pages), attrs: map[string]int64{"sip": ip(10, 9, 9, 9), "dip": 1, "svc": 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(expect) || pages != (len(expect)+6)/7 {
+		t.Error("No Pass", pages, ids)
+	}
+	if len(e.pages.snapshots) != 0 {
+		t.Error("No Pass", len(e.pages.snapshots))
+	}
+
+	page, err := e.SearchPage(search, 5, "")
+	if err != nil || len(page.IDs) != 5 || page.Cursor == "" {
+		t.Fatal(page, err)
+	}
+	if _, err := e.SearchPage(&testSearch{attrs: map[string]uint64{"svc": 1}}, 5, page.Cursor); err == nil {
+		t.Error("No Pass")
+	}
+	// 显示相同的In和Range查询不共用游标
+	key := func(v int64) []byte {
+		return IntXXToBytes(v, 32)
+	}
+	in, err := e.SearchPage(&testSearch{filter: trie.In("svc", key(1), key(2))}, 5, "")
+	if err != nil || in.Cursor == "" {
+		t.Fatal(in, err)
+	}
+	if _, err := e.SearchPage(&testSearch{filter: trie.Range("svc", key(1), key(2))}, 5, in.Cursor); err == nil {
+		t.Error("No Pass")
+	}
+	for _, cursor := range []string{"xyz", page.Cursor[:10]} {
+		if _, err := e.SearchPage(search, 5, cursor); err == nil {
+			t.Error("No Pass", cursor)
+		}
+	}
+	if _, err := e.SearchPage(search, 0, ""); err == nil {
+		t.Error("No Pass")
+	}
+
+	// 快照被丢弃后没有写入时重新计算, 有写入时游标失效
+	for i := 0; i < maxPageSnapshots; i++ {
+		if _, err := e.SearchPage(search, 1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := e.pages.get(mustParseCursor(t, page.Cursor).snapshot); ok {
+		t.Error("No Pass")
+	}
+	next, err := e.SearchPage(search, 5, page.Cursor)
+	if err != nil || len(next.IDs) != 5 || next.IDs[0] <= page.IDs[4] {
+		t.Error("No Pass", next, err)
+	}
+
+	for i := 0; i < maxPageSnapshots; i++ {
+		if _, err := e.SearchPage(search, 1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Delete(100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.SearchPage(search, 5, next.Cursor); err != ErrCursorExpired {
+		t.Error("No Pass", err)
+	}
+}
+
+func TestEngine_Concurrent(t *testing.T) {
+	e := newTestEngine(t)
+	e.SetResultCache(NewResultCache(16))
+
+	search := &testSearch{filter: trie.CIDR("sip", IntXXToBytes(ip(10, 0, 0, 0), 32), 8)}
+	flow := Flow{SrcIP: uint32(ip(10, 0, 0, 1)), DstIP: uint32(ip(192, 168, 1, 1)), Proto: 6, DstPort: 22}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := uint64(1000 + w*1000 + i)
+				r := &testRule{id: id, attrs: map[string]int64{"sip": ip(10, 5, byte(w), byte(i)), "dip": ip(192, 168, 1, 1), "svc": 22}}
+				if _, err := e.Index(r); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+				if i%2 == 0 {
+					if err := e.Delete(id); err != nil {
+						t.Error("No Pass", err)
+						return
+					}
+				}
+			}
+		}(w)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if _, err := e.Search(search); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+				if _, err := e.MatchTopK(flow, 3); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+				if _, err := e.SearchPage(search, 10, ""); err != nil {
+					t.Error("No Pass", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 每个写入协程保留奇数编号的100条规则, 加上sip在10/8中的3条原有规则
+	if ids, err := e.Search(search); err != nil || len(ids) != 4*100+3 {
+		t.Error("No Pass", len(ids), err)
+	}
+}
+
+func mustParseCursor(t *testing.T, cursor string) *pageCursor {
+	c, err := parsePageCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
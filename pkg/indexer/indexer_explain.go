@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// ExplainStep 查询计划结点及其实际执行情况, 子结点按执行顺序排列
+type ExplainStep struct {
+	Filter   string
+	Strategy Strategy
+	// Attr 访问的属性trie, 组合结点为空
+	Attr     string
+	Estimate int
+	Cost     int
+
+	// Actual 结果中value的数量, Blocks 结果VPack的大小
+	Actual int
+	Blocks int
+	// Candidates StrategyFilter 过滤的候选value数量
+	Candidates int
+	// Scan 访问属性trie时的chunk、结点和key的数量
+	Scan     trie.ScanStats
+	Duration time.Duration
+	// Skipped 结果已经为空, 该结点没有执行
+	Skipped bool
+
+	Children []*ExplainStep
+}
+
+func newExplainStep(plan *PlanNode) *ExplainStep {
+	step := &ExplainStep{
+		Filter:   plan.Filter.String(),
+		Strategy: plan.Strategy,
+		Estimate: plan.Estimate,
+		Cost:     plan.Cost,
+	}
+
+	if f, ok := plan.Filter.(*trie.AttrFilter); ok {
+		step.Attr = f.Attr
+	}
+
+	return step
+}
+
+func (step *ExplainStep) finish(pack *vpack.VPack, start time.Time) {
+	step.Duration = time.Since(start)
+	if pack != nil {
+		step.Actual = pack.Count()
+		step.Blocks = pack.Size()
+	}
+}
+
+// skip 记录没有执行的子结点, 保证输出包含完整的计划
+func (step *ExplainStep) skip(plans []*PlanNode) {
+	for _, plan := range plans {
+		child := newExplainStep(plan)
+		child.Skipped = true
+		step.Children = append(step.Children, child)
+	}
+}
+
+// Explain 执行过滤表达式并返回查询计划和每一步的实际执行情况
+func (indexer *Indexer) Explain(f trie.Filter) (*ExplainStep, error) {
+	step, _, err := indexer.explain(f)
+	return step, err
+}
+
+// explain 同 Explain, 同时返回执行的结果
+func (indexer *Indexer) explain(f trie.Filter) (*ExplainStep, *vpack.VPack, error) {
+	plan, err := indexer.Plan(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	step := newExplainStep(plan)
+
+	start := time.Now()
+	pack, err := indexer.execute(context.Background(), plan, indexer.all, step)
+	if err != nil {
+		return nil, nil, err
+	}
+	step.finish(pack, start)
+
+	return step, pack, nil
+}
+
+// String 每个结点一行, 子结点缩进两个空格
+func (step *ExplainStep) String() string {
+	var sb strings.Builder
+	step.format(&sb, 0)
+
+	return sb.String()
+}
+
+func (step *ExplainStep) format(sb *strings.Builder, depth int) {
+	sb.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(sb, "%s", step.Strategy)
+	if step.Attr != "" {
+		fmt.Fprintf(sb, " %s", step.Attr)
+	}
+	fmt.Fprintf(sb, ": %s", step.Filter)
+
+	if step.Skipped {
+		fmt.Fprintf(sb, " (estimate=%d cost=%d skipped)\n", step.Estimate, step.Cost)
+	} else {
+		fmt.Fprintf(sb, " (estimate=%d cost=%d actual=%d blocks=%d", step.Estimate, step.Cost, step.Actual, step.Blocks)
+		if step.Attr != "" && step.Strategy != StrategyFilter {
+			fmt.Fprintf(sb, " chunks=%d nodes=%d keys=%d", step.Scan.Chunks, step.Scan.Nodes, step.Scan.Keys)
+		}
+		if step.Strategy == StrategyFilter {
+			fmt.Fprintf(sb, " candidates=%d", step.Candidates)
+		}
+		fmt.Fprintf(sb, " time=%s)\n", step.Duration)
+	}
+
+	for _, child := range step.Children {
+		child.format(sb, depth+1)
+	}
+}
@@ -0,0 +1,364 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+type constraintKind int
+
+const (
+	constraintAny constraintKind = iota
+	constraintValue
+	constraintCIDR
+	constraintInterval
+	constraintTernary
+)
+
+// Constraint 规则在单个属性上的约束, 取值均为无符号数
+type Constraint struct {
+	kind  constraintKind
+	start uint64
+	end   uint64
+	bits  int
+
+	// negate 匹配约束之外的取值
+	negate bool
+}
+
+// Any 匹配任意值
+func Any() Constraint {
+	return Constraint{kind: constraintAny}
+}
+
+// Value 只匹配v
+func Value(v uint64) Constraint {
+	return Constraint{kind: constraintValue, start: v, end: v}
+}
+
+// CIDR 匹配高bits位与v相同的值, 例如 CIDR(10<<24, 8) 表示 10.0.0.0/8
+func CIDR(v uint64, bits int) Constraint {
+	return Constraint{kind: constraintCIDR, start: v, bits: bits}
+}
+
+// Interval 匹配[start, end]
+func Interval(start, end uint64) Constraint {
+	return Constraint{kind: constraintInterval, start: start, end: end}
+}
+
+// Ternary 匹配 v&mask == value&mask 的值, 例如 Ternary(0x0050, 0xfff0) 匹配端口 0x0050-0x005f;
+// mask 为连续的高位时等同于CIDR, 否则存储在按mask分支的三态trie中
+func Ternary(value, mask uint64) Constraint {
+	return Constraint{kind: constraintTernary, start: value & mask, end: mask}
+}
+
+// Not 匹配c之外的取值, 例如 Not(CIDR(10<<24, 8)) 表示 dip NOT in 10.0.0.0/8
+func Not(c Constraint) Constraint {
+	c.negate = !c.negate
+	return c
+}
+
+// attrKeys 同一属性上的约束转换得到的key, keys 为前缀, ternary 为三态key, 都为nil表示通配
+type attrKeys struct {
+	keys    [][]byte
+	ternary [][]byte
+	negate  bool
+}
+
+func (ak *attrKeys) any() bool {
+	return ak.keys == nil && ak.ternary == nil
+}
+
+// constraintKeys 将同一属性上的多个约束转换为前缀和三态key;
+// 取反的约束合并为一个排除集合, 不能与普通约束混用, 也不能是三态的
+func constraintKeys(cs []Constraint, byteLen uint32) (*attrKeys, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("no constraint")
+	}
+
+	var (
+		ret = &attrKeys{negate: cs[0].negate}
+		any bool
+	)
+	for _, c := range cs {
+		if c.negate != ret.negate {
+			return nil, errors.New("negated and plain constraints can not be mixed")
+		}
+
+		if c.kind == constraintTernary {
+			key, cidr, err := c.ternaryKey(byteLen)
+			if err != nil {
+				return nil, err
+			}
+
+			if key != nil {
+				if c.negate {
+					return nil, errors.New("negated ternary constraint is not supported")
+				}
+				ret.ternary = append(ret.ternary, key)
+				continue
+			}
+			c = cidr
+		}
+
+		ks, err := c.keys(byteLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if ks == nil {
+			if ret.negate {
+				return nil, errors.New("negated constraint matches nothing")
+			}
+			any = true
+		}
+		ret.keys = append(ret.keys, ks...)
+	}
+
+	if any {
+		return &attrKeys{}, nil
+	}
+	return ret, nil
+}
+
+// ternaryKey 三态约束的mask为连续的高位时返回等价的CIDR, 否则返回三态key
+func (c Constraint) ternaryKey(byteLen uint32) ([]byte, Constraint, error) {
+	width := int(byteLen)
+	max := uint64(math.MaxUint64)
+	if width < 64 {
+		max = 1<<uint(width) - 1
+	}
+
+	if c.end > max {
+		return nil, c, fmt.Errorf("mask %#x is out of range", c.end)
+	}
+
+	// 取反后只有低位为1时, mask 是连续的高位
+	inv := max &^ c.end
+	if inv&(inv+1) == 0 {
+		cidr := CIDR(c.start, width-bits.OnesCount64(inv))
+		cidr.negate = c.negate
+		return nil, cidr, nil
+	}
+
+	return trie.TernaryKey(IntXXToBytes(int64(c.start), byteLen), IntXXToBytes(int64(c.end), byteLen)), c, nil
+}
+
+// keys 将约束拆分为属性trie中按字节对齐的前缀, 通配时返回nil
+func (c Constraint) keys(byteLen uint32) ([][]byte, error) {
+	width := int(byteLen)
+	max := uint64(math.MaxUint64)
+	if width < 64 {
+		max = 1<<uint(width) - 1
+	}
+
+	start, end := c.start, c.end
+	switch c.kind {
+	case constraintAny:
+		return nil, nil
+	case constraintCIDR:
+		if c.bits < 0 || c.bits > width {
+			return nil, fmt.Errorf("cidr bits %d is out of range", c.bits)
+		}
+
+		// 主机位清零, 得到对齐的区间
+		host := uint(width - c.bits)
+		if host == 64 {
+			start, end = 0, max
+		} else {
+			start = c.start >> host << host
+			end = start | (1<<host - 1)
+		}
+	}
+
+	if start > end || end > max {
+		return nil, fmt.Errorf("interval [%d, %d] is out of range", start, end)
+	}
+
+	return intervalKeys(start, end, width/8), nil
+}
+
+// intervalKeys 将[start, end]拆分为最少的按字节对齐的前缀, 整个取值空间返回nil
+func intervalKeys(start, end uint64, n int) [][]byte {
+	var keys [][]byte
+	for {
+		// 找到以start开头且不超过end的最大对齐块, 块大小为 256^k
+		k := 0
+		for k < n && blockFits(start, end, 8*(k+1)) {
+			k++
+		}
+
+		if k == n {
+			return nil
+		}
+
+		key := make([]byte, n-k)
+		for i := range key {
+			key[i] = byte(start >> uint(8*(n-1-i)))
+		}
+		keys = append(keys, key)
+
+		next := start + 1<<uint(8*k)
+		if next <= start || next > end {
+			return keys
+		}
+		start = next
+	}
+}
+
+// blockFits 以start开头、大小为2^bits的块是否对齐且完全落在[start, end]中
+func blockFits(start, end uint64, bits int) bool {
+	if bits >= 64 {
+		return start == 0 && end == math.MaxUint64
+	}
+
+	mask := uint64(1)<<uint(bits) - 1
+	return start&mask == 0 && end-start >= mask
+}
+
+// Flow 五元组
+type Flow struct {
+	SrcIP   uint32
+	DstIP   uint32
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Service svc属性的取值, 高位为协议号, 低16位为目的端口
+func Service(proto uint8, port uint16) uint64 {
+	return uint64(proto)<<16 | uint64(port)
+}
+
+// values 五元组对应的属性取值, 引擎中不存在的属性(例如sport)不参与匹配
+func (f *Flow) values() map[string]uint64 {
+	return map[string]uint64{
+		"sip":   uint64(f.SrcIP),
+		"dip":   uint64(f.DstIP),
+		"svc":   Service(f.Proto, f.DstPort),
+		"sport": uint64(f.SrcPort),
+	}
+}
+
+// matcher 计算覆盖给定取值的value, 缓存每个属性上的结果供批量匹配复用
+type matcher struct {
+	indexer *Indexer
+
+	// 每个属性最多缓存的取值数量, 0 表示不缓存
+	limit int
+	cache map[string]map[uint64]*vpack.VPack
+}
+
+// matchCacheLimit 批量匹配时每个属性缓存的取值数量
+const matchCacheLimit = 1 << 16
+
+func (indexer *Indexer) newMatcher(limit int) *matcher {
+	return &matcher{
+		indexer: indexer,
+		limit:   limit,
+		cache:   make(map[string]map[uint64]*vpack.VPack),
+	}
+}
+
+// Match 查找每个属性的约束都覆盖给定取值的value, values 中没有的属性不做限制
+func (indexer *Indexer) Match(values map[string]uint64) (*vpack.VPack, error) {
+	return indexer.MatchContext(context.Background(), values)
+}
+
+// MatchContext 同 Match, 每个属性查找前和每次求交集前检查ctx, ctx 被取消或超时时返回 ctx.Err()
+func (indexer *Indexer) MatchContext(ctx context.Context, values map[string]uint64) (*vpack.VPack, error) {
+	return indexer.newMatcher(0).match(ctx, values)
+}
+
+func (m *matcher) match(ctx context.Context, values map[string]uint64) (*vpack.VPack, error) {
+	packs := make([]*vpack.VPack, 0, len(values))
+	for attr, v := range values {
+		item, ok := m.indexer.attrItems[attr]
+		if !ok || item == nil {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		pack, err := m.covering(attr, item, v)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+
+	if len(packs) == 0 {
+		return nil, errors.New("no attribute to match")
+	}
+
+	// 从最小的集合开始求交集
+	sort.Slice(packs, func(i, j int) bool {
+		return packs[i].Size() < packs[j].Size()
+	})
+
+	if len(packs) == 1 {
+		// 不能返回缓存中的VPack
+		pack := vpack.NewValuePack(0, 0)
+		pack.Merge(packs[0])
+		return pack, nil
+	}
+
+	pack := vpack.Intersect(packs[0], packs[1])
+	for _, other := range packs[2:] {
+		if pack.Size() == 0 {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pack = vpack.Intersect(pack, other)
+	}
+
+	return pack, nil
+}
+
+// covering 属性上覆盖v的所有value: v的所有前缀上的value、通配的value、排除集合不包含v的value以及三态匹配的value
+func (m *matcher) covering(attr string, item *attrItem, v uint64) (*vpack.VPack, error) {
+	cache := m.cache[attr]
+	if pack, ok := cache[v]; ok {
+		return pack, nil
+	}
+
+	if item.str || item.timed {
+		return nil, fmt.Errorf("attribute %s can not be matched by value", attr)
+	}
+
+	if item.byteLen < 64 && v >= 1<<item.byteLen {
+		return nil, fmt.Errorf("attribute %s value %d is out of range", attr, v)
+	}
+
+	key := IntXXToBytes(int64(v), item.byteLen)
+	pack := vpack.NewValuePack(0, 0)
+	item.trie.PrefixesOf(key, nil, func(key []byte, vals *vpack.VPack) bool {
+		pack.Merge(vals)
+		return true
+	})
+	pack.Merge(item.any)
+	pack.Merge(item.notMatching(key, nil))
+	pack.Merge(item.ternaryMatching(key, nil))
+
+	if m.limit > 0 {
+		if cache == nil || len(cache) >= m.limit {
+			cache = make(map[uint64]*vpack.VPack)
+			m.cache[attr] = cache
+		}
+		cache[v] = pack
+	}
+
+	return pack, nil
+}
@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// ErrCursorExpired 游标的快照已被丢弃且之后有写入, 需要从第一页重新查询
+var ErrCursorExpired = errors.New("cursor is expired")
+
+// Page 分页查询的一页结果, Cursor 为空表示没有下一页
+type Page struct {
+	IDs    []uint64
+	Cursor string
+}
+
+// maxPageSnapshots 最多保存的分页快照数量, 超过时丢弃最早的快照
+const maxPageSnapshots = 64
+
+// pageCursor 游标的内容: 第一页时的写入代数、快照编号、上一页最后的id和查询的hash
+type pageCursor struct {
+	generation uint64
+	snapshot   uint64
+	last       uint64
+	query      uint64
+}
+
+const pageCursorLen = 32
+
+func (c *pageCursor) encode() string {
+	buf := make([]byte, pageCursorLen)
+	binary.BigEndian.PutUint64(buf[0:], c.generation)
+	binary.BigEndian.PutUint64(buf[8:], c.snapshot)
+	binary.BigEndian.PutUint64(buf[16:], c.last)
+	binary.BigEndian.PutUint64(buf[24:], c.query)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func parsePageCursor(cursor string) (*pageCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != pageCursorLen {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	return &pageCursor{
+		generation: binary.BigEndian.Uint64(buf[0:]),
+		snapshot:   binary.BigEndian.Uint64(buf[8:]),
+		last:       binary.BigEndian.Uint64(buf[16:]),
+		query:      binary.BigEndian.Uint64(buf[24:]),
+	}, nil
+}
+
+// pageSnapshots 分页查询第一页时的完整结果, 之后的页从快照中定位, 不受期间写入的影响
+type pageSnapshots struct {
+	mu    sync.Mutex
+	limit int
+	// order 按创建顺序排列的快照编号, 超过limit时丢弃最早的
+	order     []uint64
+	snapshots map[uint64]*vpack.VPack
+}
+
+func (ps *pageSnapshots) init(limit int) {
+	ps.limit = limit
+	ps.snapshots = make(map[uint64]*vpack.VPack)
+}
+
+func (ps *pageSnapshots) get(id uint64) (*vpack.VPack, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	pack, ok := ps.snapshots[id]
+	return pack, ok
+}
+
+func (ps *pageSnapshots) put(id uint64, pack *vpack.VPack) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.snapshots[id] = pack
+	ps.order = append(ps.order, id)
+
+	for len(ps.snapshots) > ps.limit && len(ps.order) > 0 {
+		delete(ps.snapshots, ps.order[0])
+		ps.order = ps.order[1:]
+	}
+}
+
+func (ps *pageSnapshots) remove(id uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.snapshots[id]; !ok {
+		return
+	}
+
+	delete(ps.snapshots, id)
+	for i, other := range ps.order {
+		if other == id {
+			ps.order = append(ps.order[:i], ps.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// SearchPage 分页查询, 每页最多limit个id; cursor 为空时返回第一页, 否则从上一页返回的Cursor继续,
+// 此时r必须与第一页相同. 第一页的结果作为快照保存, 之后的页在快照中按id定位, 不重新计算也不跳过已返回的id;
+// 快照被丢弃后, 第一页之后没有写入时重新计算结果, 否则返回 ErrCursorExpired
+func (e *engine) SearchPage(r SearchRule, limit int, cursor string) (*Page, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("page limit %d is illegal", limit)
+	}
+
+	f := e.searchFilter(r)
+	h := fnv.New64a()
+	h.Write([]byte(FilterKey(f)))
+
+	c := &pageCursor{query: h.Sum64()}
+	var (
+		pack  *vpack.VPack
+		start uint64
+		saved bool
+	)
+	if cursor == "" {
+		c.generation = atomic.LoadUint64(&e.generation)
+		c.snapshot = e.sequencer.Get()
+	} else {
+		prev, err := parsePageCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if prev.query != c.query {
+			return nil, errors.New("cursor does not belong to the search")
+		}
+
+		c.generation, c.snapshot = prev.generation, prev.snapshot
+		start = prev.last + 1
+
+		pack, saved = e.pages.get(c.snapshot)
+		if !saved && c.generation != atomic.LoadUint64(&e.generation) {
+			return nil, ErrCursorExpired
+		}
+	}
+
+	if pack == nil {
+		var err error
+		if pack, err = e.search(context.Background(), f); err != nil {
+			return nil, err
+		}
+	}
+
+	// 多取一个id判断是否还有下一页
+	ids := pack.UnpackFrom(start, limit+1)
+	if len(ids) <= limit {
+		e.pages.remove(c.snapshot)
+		return &Page{IDs: ids}, nil
+	}
+
+	if !saved {
+		e.pages.put(c.snapshot, pack)
+	}
+
+	ids = ids[:limit]
+	c.last = ids[limit-1]
+	return &Page{IDs: ids, Cursor: c.encode()}, nil
+}
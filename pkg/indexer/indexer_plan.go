@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/anbien/polyer/pkg/trie"
+)
+
+// Strategy 查询计划结点的执行方式
+type Strategy string
+
+const (
+	// StrategyPoint 逐个key查找posting
+	StrategyPoint Strategy = "point"
+	// StrategyRange 带剪枝的trie遍历, 合并范围内的posting
+	StrategyRange Strategy = "range"
+	// StrategyFilter 使用正排信息逐个过滤候选value, 候选集为前面的结果或全集
+	StrategyFilter Strategy = "filter"
+	// StrategyNegate 全集减去子结点的结果
+	StrategyNegate Strategy = "negate"
+	// StrategyAntiJoin AND中的NOT, 从前面的结果中减去子结点的结果
+	StrategyAntiJoin Strategy = "anti-join"
+	// StrategyIntersect 按估计值从小到大求交集
+	StrategyIntersect Strategy = "intersect"
+	// StrategyUnion 求并集
+	StrategyUnion Strategy = "union"
+)
+
+// 代价模型, 单位为处理一个value的代价
+const (
+	// lookupCost 查找一个key并合并其posting的额外代价
+	lookupCost = 8
+	// filterCost 使用正排信息判断一个value的代价
+	filterCost = 4
+)
+
+// PlanNode 查询计划结点
+type PlanNode struct {
+	Filter   trie.Filter
+	Strategy Strategy
+	// Estimate 估计的结果数量
+	Estimate int
+	// Cost 估计的执行代价
+	Cost     int
+	Children []*PlanNode
+}
+
+type planner struct {
+	indexer *Indexer
+	total   int
+}
+
+// Plan 为过滤表达式生成查询计划
+func (indexer *Indexer) Plan(f trie.Filter) (*PlanNode, error) {
+	p := &planner{
+		indexer: indexer,
+		total:   indexer.all.Count(),
+	}
+
+	node, err := p.plan(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// 非常宽泛的谓词直接扫描全集
+	if node.Strategy == StrategyRange && p.filterCost(p.total) < node.Cost {
+		node.Strategy = StrategyFilter
+		node.Cost = p.filterCost(p.total)
+	}
+
+	return node, nil
+}
+
+func (p *planner) plan(f trie.Filter) (*PlanNode, error) {
+	switch f := f.(type) {
+	case *trie.AttrFilter:
+		return p.planAttr(f)
+	case *trie.AndFilter:
+		return p.planAnd(f)
+	case *trie.OrFilter:
+		node := &PlanNode{Filter: f, Strategy: StrategyUnion}
+		for _, sub := range f.Filters {
+			child, err := p.plan(sub)
+			if err != nil {
+				return nil, err
+			}
+
+			node.Children = append(node.Children, child)
+			node.Estimate += child.Estimate
+			node.Cost += child.Cost + child.Estimate
+		}
+
+		if node.Estimate > p.total {
+			node.Estimate = p.total
+		}
+		return node, nil
+	case *trie.NotFilter:
+		child, err := p.plan(f.Filter)
+		if err != nil {
+			return nil, err
+		}
+
+		return &PlanNode{
+			Filter:   f,
+			Strategy: StrategyNegate,
+			Estimate: p.total - child.Estimate,
+			Cost:     child.Cost + p.total,
+			Children: []*PlanNode{child},
+		}, nil
+	case nil:
+		return nil, errors.New("filter is nil")
+	}
+
+	return nil, fmt.Errorf("unsupport filter %s", f)
+}
+
+func (p *planner) planAttr(f *trie.AttrFilter) (*PlanNode, error) {
+	item, ok := p.indexer.attrItems[f.Attr]
+	if !ok || item == nil {
+		return nil, fmt.Errorf("not exsit the attr item %s in the tree", f.Attr)
+	}
+
+	node := &PlanNode{Filter: f, Strategy: StrategyRange}
+
+	var keys [][]byte
+	switch pred := f.Pred.(type) {
+	case *trie.EqPredicate:
+		keys = [][]byte{pred.Key}
+	case *trie.InPredicate:
+		keys = pred.Keys
+	}
+
+	if keys != nil {
+		node.Strategy = StrategyPoint
+		for _, key := range keys {
+			if item.stats != nil {
+				node.Estimate += item.stats.postings(key)
+			} else if pack := item.trie.Lookup(key); pack != nil {
+				node.Estimate += pack.Count()
+			}
+		}
+		node.Cost = len(keys)*lookupCost + node.Estimate
+	} else {
+		// 聚合信息使范围统计只需要访问边界结点
+		keyNum, values := item.trie.FilterCount(f.Pred)
+		node.Estimate = values
+		node.Cost = keyNum*lookupCost + values
+	}
+
+	// 通配的value总是在结果中, 取反和三态的value按最坏情况估计
+	extra := item.any.Count() + item.not.Count() + item.ternaryValues.Count()
+	node.Estimate += extra
+	node.Cost += extra
+
+	if node.Estimate > p.total {
+		node.Estimate = p.total
+	}
+	return node, nil
+}
+
+// planAnd 选择性高的子表达式先执行, NOT放在最后从结果中减去;
+// 当前结果已经很小时, 逐个过滤比展开posting更便宜
+func (p *planner) planAnd(f *trie.AndFilter) (*PlanNode, error) {
+	node := &PlanNode{Filter: f, Strategy: StrategyIntersect, Estimate: p.total}
+	for _, sub := range f.Filters {
+		child, err := p.plan(sub)
+		if err != nil {
+			return nil, err
+		}
+
+		if child.Strategy == StrategyNegate {
+			child.Strategy = StrategyAntiJoin
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		a, b := node.Children[i], node.Children[j]
+		if (a.Strategy == StrategyAntiJoin) != (b.Strategy == StrategyAntiJoin) {
+			return b.Strategy == StrategyAntiJoin
+		}
+		return a.Estimate < b.Estimate
+	})
+
+	for i, child := range node.Children {
+		if i > 0 && p.filterCost(node.Estimate) < p.materializeCost(child) {
+			child.Strategy = StrategyFilter
+			child.Cost = p.filterCost(node.Estimate)
+		}
+
+		node.Cost += child.Cost
+		if child.Estimate < node.Estimate {
+			node.Estimate = child.Estimate
+		}
+	}
+
+	return node, nil
+}
+
+// materializeCost 在AND中展开子结点结果的代价
+func (p *planner) materializeCost(node *PlanNode) int {
+	if node.Strategy == StrategyAntiJoin {
+		// 减法只需要子表达式本身的结果, 不需要求全集的补集
+		return node.Children[0].Cost
+	}
+
+	return node.Cost
+}
+
+func (p *planner) filterCost(candidates int) int {
+	return candidates * filterCost
+}
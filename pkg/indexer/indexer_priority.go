@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// PriorityRule 带优先级的规则, 数值越小优先级越高, 未实现时优先级为0;
+// 优先级相同时id小的优先
+type PriorityRule interface {
+	Priority() int
+}
+
+// SetPriority 设置已索引value的优先级
+func (indexer *Indexer) SetPriority(value uint64, priority int) error {
+	md, ok := indexer.metadataTable[int64(value)]
+	if !ok {
+		return fmt.Errorf("value %d is not indexed", value)
+	}
+
+	if md.priority == priority {
+		return nil
+	}
+
+	indexer.unsetPriority(value, md.priority)
+	if priority != 0 {
+		pack, ok := indexer.priorities[priority]
+		if !ok {
+			pack = vpack.NewValuePack(0, 0)
+			indexer.priorities[priority] = pack
+		}
+		pack.Add(value)
+		indexer.prioritized.Add(value)
+	}
+
+	md.priority = priority
+	return nil
+}
+
+// unsetPriority 将value从优先级分组中移除, 分组为空时删除
+func (indexer *Indexer) unsetPriority(value uint64, priority int) {
+	if priority == 0 {
+		return
+	}
+
+	if pack, ok := indexer.priorities[priority]; ok {
+		pack.Remove(value)
+		if pack.Size() == 0 {
+			delete(indexer.priorities, priority)
+		}
+	}
+	indexer.prioritized.Remove(value)
+}
+
+// priorityOf 返回value的优先级, value的正排信息一定存在
+func (indexer *Indexer) priorityOf(value uint64) int {
+	if md, ok := indexer.metadataTable[int64(value)]; ok {
+		return md.priority
+	}
+
+	return 0
+}
+
+// better a是否比b优先
+func (indexer *Indexer) better(a, b uint64) bool {
+	pa, pb := indexer.priorityOf(a), indexer.priorityOf(b)
+	if pa != pb {
+		return pa < pb
+	}
+
+	return a < b
+}
+
+// TopK 按优先级返回pack中最优的k个value, 不对整个结果排序.
+// 优先级分组较少时按优先级从高到低与每组求交集, 每组只解包还需要的value;
+// 分组多于结果的平均块密度时逐个遍历pack, 只维护大小为k的堆
+func (indexer *Indexer) TopK(pack *vpack.VPack, k int) []uint64 {
+	if k <= 0 || pack.Size() == 0 {
+		return nil
+	}
+
+	if (len(indexer.priorities)+1)*pack.Size() <= pack.Count() {
+		return indexer.topKByLevel(pack, k)
+	}
+
+	return indexer.topKByHeap(pack, k)
+}
+
+func (indexer *Indexer) topKByLevel(pack *vpack.VPack, k int) []uint64 {
+	levels := make([]int, 0, len(indexer.priorities)+1)
+	levels = append(levels, 0)
+	for priority := range indexer.priorities {
+		levels = append(levels, priority)
+	}
+	sort.Ints(levels)
+
+	var ret []uint64
+	for _, priority := range levels {
+		var sub *vpack.VPack
+		if priority == 0 {
+			sub = vpack.Difference(pack, indexer.prioritized)
+		} else {
+			sub = vpack.Intersect(pack, indexer.priorities[priority])
+		}
+
+		// 同一优先级中id小的优先, 正好是升序
+		ret = append(ret, sub.UnpackFrom(0, k-len(ret))...)
+		if len(ret) == k {
+			break
+		}
+	}
+
+	return ret
+}
+
+func (indexer *Indexer) topKByHeap(pack *vpack.VPack, k int) []uint64 {
+	h := &priorityHeap{}
+	for _, block := range pack.Data() {
+		for _, v := range block.UnPack() {
+			e := rankedValue{value: v, priority: indexer.priorityOf(v)}
+			if h.Len() < k {
+				heap.Push(h, e)
+			} else if e.better(h.values[0]) {
+				h.values[0] = e
+				heap.Fix(h, 0)
+			}
+		}
+	}
+
+	ret := make([]uint64, h.Len())
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] = heap.Pop(h).(rankedValue).value
+	}
+
+	return ret
+}
+
+// rankedValue 记录value的优先级, 堆中比较时不需要再查找正排信息
+type rankedValue struct {
+	value    uint64
+	priority int
+}
+
+func (a rankedValue) better(b rankedValue) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+
+	return a.value < b.value
+}
+
+// priorityHeap 堆顶是当前k个value中最差的
+type priorityHeap struct {
+	values []rankedValue
+}
+
+func (h *priorityHeap) Len() int {
+	return len(h.values)
+}
+
+func (h *priorityHeap) Less(i, j int) bool {
+	return h.values[j].better(h.values[i])
+}
+
+func (h *priorityHeap) Swap(i, j int) {
+	h.values[i], h.values[j] = h.values[j], h.values[i]
+}
+
+func (h *priorityHeap) Push(x interface{}) {
+	h.values = append(h.values, x.(rankedValue))
+}
+
+func (h *priorityHeap) Pop() interface{} {
+	n := len(h.values)
+	v := h.values[n-1]
+	h.values = h.values[:n-1]
+
+	return v
+}
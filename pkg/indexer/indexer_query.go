@@ -0,0 +1,679 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+)
+
+// 查询语言, 例如:
+//
+//	sip = 10.0.0.0/8 AND dip IN [192.168.1.1, 192.168.1.9] AND NOT svc = 22
+//	host PREFIX "web-" AND user >= "a" AND user < "m"
+//	host ~ "^api-[0-9]+\\.prod\\."
+//
+// 语法:
+//
+//	expr  := and { OR and }
+//	and   := unary { AND unary }
+//	unary := NOT unary | '(' expr ')' | cond
+//	cond  := attr ('=' | '!=' | '<' | '<=' | '>' | '>=') value
+//	       | attr '~' string
+//	       | attr IN '[' value { ',' value } ']'
+//	       | attr PREFIX string
+//	value := 数字(十进制或0x十六进制) | IPv4 | IPv4/前缀长度 | string
+//	         时间属性的值为RFC3339格式的string, 例如 "2026-10-19T10:00:00Z"
+//	string := 双引号括起的字符串, 支持 \" 和 \\ 转义, 只能用于字符串属性和时间属性
+//
+// 关键字不区分大小写, 字符串属性按字典序比较, '~' 为正则匹配, 语法与regexp相同;
+// 同一个AND中对同一属性的比较合并为一个区间, 例如 dip >= 10.1.0.0 AND dip <= 10.2.0.0,
+// 取反约束的规则只有在区间中存在排除集合之外的取值时才满足
+
+// QueryError 查询语句错误, Column 从1开始
+type QueryError struct {
+	Column int
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenIP
+	tokenCIDR
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenIn
+	tokenPrefix
+)
+
+var tokenNames = map[tokenKind]string{
+	tokenEOF:      "end of query",
+	tokenIdent:    "attribute",
+	tokenNumber:   "number",
+	tokenIP:       "ip",
+	tokenCIDR:     "cidr",
+	tokenString:   "string",
+	tokenOp:       "operator",
+	tokenLParen:   "'('",
+	tokenRParen:   "')'",
+	tokenLBracket: "'['",
+	tokenRBracket: "']'",
+	tokenComma:    "','",
+	tokenAnd:      "AND",
+	tokenOr:       "OR",
+	tokenNot:      "NOT",
+	tokenIn:       "IN",
+	tokenPrefix:   "PREFIX",
+}
+
+var keywords = map[string]tokenKind{
+	"AND":    tokenAnd,
+	"OR":     tokenOr,
+	"NOT":    tokenNot,
+	"IN":     tokenIn,
+	"PREFIX": tokenPrefix,
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	// 起始位置, 从0开始
+	pos int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return tokenNames[t.kind]
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex 将查询语句切分为token
+func lex(query string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isLetter(c):
+			start := i
+			for i < len(query) && (isLetter(query[i]) || isDigit(query[i])) {
+				i++
+			}
+
+			text := query[start:i]
+			kind, ok := keywords[strings.ToUpper(text)]
+			if !ok {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+			continue
+		case c == '"':
+			start := i
+			var sb strings.Builder
+			for i++; i < len(query) && query[i] != '"'; i++ {
+				if query[i] == '\\' && i+1 < len(query) {
+					i++
+				}
+				sb.WriteByte(query[i])
+			}
+
+			if i == len(query) {
+				return nil, &QueryError{Column: start + 1, Msg: "unterminated string"}
+			}
+			i++
+
+			tokens = append(tokens, token{kind: tokenString, text: sb.String(), pos: start})
+			continue
+		case isDigit(c):
+			start := i
+			for i < len(query) && (isLetter(query[i]) || isDigit(query[i]) || query[i] == '.' || query[i] == '/') {
+				i++
+			}
+
+			text := query[start:i]
+			kind := tokenNumber
+			if strings.Contains(text, "/") {
+				kind = tokenCIDR
+			} else if strings.Contains(text, ".") {
+				kind = tokenIP
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+			continue
+		}
+
+		var tok = token{text: string(c), pos: i}
+		switch c {
+		case '(':
+			tok.kind = tokenLParen
+		case ')':
+			tok.kind = tokenRParen
+		case '[':
+			tok.kind = tokenLBracket
+		case ']':
+			tok.kind = tokenRBracket
+		case ',':
+			tok.kind = tokenComma
+		case '=', '~':
+			tok.kind = tokenOp
+		case '!', '<', '>':
+			tok.kind = tokenOp
+			if i+1 < len(query) && query[i+1] == '=' {
+				tok.text = query[i : i+2]
+			} else if c == '!' {
+				return nil, &QueryError{Column: i + 1, Msg: "expect '=' after '!'"}
+			}
+		default:
+			return nil, &QueryError{Column: i + 1, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+
+		i += len(tok.text)
+		tokens = append(tokens, tok)
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(query)}), nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// ParseQuery 解析查询语句, 并根据索引的属性定义做类型检查, 生成过滤表达式
+func (indexer *Indexer) ParseQuery(query string) (trie.Filter, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{indexer: indexer, tokens: tokens}
+	f, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %s, expect AND or OR", tok)
+	}
+
+	return f, nil
+}
+
+type parser struct {
+	indexer *Indexer
+	tokens  []token
+	offset  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.offset]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.offset]
+	if tok.kind != tokenEOF {
+		p.offset++
+	}
+
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.errorf(tok, "unexpected %s, expect %s", tok, tokenNames[kind])
+	}
+
+	return tok, nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &QueryError{Column: tok.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseExpr() (trie.Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []trie.Filter{f}
+	for p.peek().kind == tokenOr {
+		p.next()
+
+		f, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return trie.Or(filters...), nil
+}
+
+func (p *parser) parseAnd() (trie.Filter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []trie.Filter{f}
+	for p.peek().kind == tokenAnd {
+		p.next()
+
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	filters = mergeRanges(filters)
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return trie.And(filters...), nil
+}
+
+// mergeRanges 将同一属性上的范围谓词合并为一个, 合并后的范围放在该属性第一次出现的位置
+func mergeRanges(filters []trie.Filter) []trie.Filter {
+	ranges := make(map[string]*trie.RangePredicate)
+	merged := filters[:0:0]
+	for _, f := range filters {
+		af, ok := f.(*trie.AttrFilter)
+		if !ok {
+			merged = append(merged, f)
+			continue
+		}
+
+		pred, ok := af.Pred.(*trie.RangePredicate)
+		if !ok {
+			merged = append(merged, f)
+			continue
+		}
+
+		r, ok := ranges[af.Attr]
+		if !ok {
+			r = &trie.RangePredicate{Start: pred.Start, End: pred.End}
+			ranges[af.Attr] = r
+			merged = append(merged, &trie.AttrFilter{Attr: af.Attr, Pred: r})
+			continue
+		}
+
+		if r.Start == nil || pred.Start != nil && bytes.Compare(pred.Start, r.Start) > 0 {
+			r.Start = pred.Start
+		}
+		if r.End == nil || pred.End != nil && bytes.Compare(pred.End, r.End) < 0 {
+			r.End = pred.End
+		}
+	}
+
+	// 空区间不满足任何value
+	for i, f := range merged {
+		if af, ok := f.(*trie.AttrFilter); ok {
+			if r, ok := ranges[af.Attr]; ok && af.Pred == r && r.Start != nil && r.End != nil && bytes.Compare(r.Start, r.End) > 0 {
+				merged[i] = trie.In(af.Attr)
+			}
+		}
+	}
+
+	return merged
+}
+
+func (p *parser) parseUnary() (trie.Filter, error) {
+	switch tok := p.peek(); tok.kind {
+	case tokenNot:
+		p.next()
+
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return trie.Not(f), nil
+	case tokenLParen:
+		p.next()
+
+		f, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case tokenIdent:
+		return p.parseCond()
+	default:
+		return nil, p.errorf(tok, "unexpected %s, expect attribute, NOT or '('", tok)
+	}
+}
+
+func (p *parser) parseCond() (trie.Filter, error) {
+	attrTok := p.next()
+
+	item, ok := p.indexer.attrItems[attrTok.text]
+	if !ok || item == nil {
+		return nil, p.errorf(attrTok, "unknown attribute %s", attrTok.text)
+	}
+
+	attr := &queryAttr{name: attrTok.text, item: item}
+
+	opTok := p.next()
+	switch opTok.kind {
+	case tokenIn:
+		return p.parseIn(attr)
+	case tokenPrefix:
+		return p.parsePrefix(attr)
+	case tokenOp:
+	default:
+		return nil, p.errorf(opTok, "unexpected %s, expect operator, IN or PREFIX", opTok)
+	}
+
+	if item.str {
+		return p.parseStringCond(attr, opTok)
+	}
+
+	if opTok.text == "~" {
+		return nil, p.errorf(opTok, "operator ~ is only supported for string attribute %s", attr.name)
+	}
+
+	v, err := p.parseValue(attr)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.cidr {
+		switch opTok.text {
+		case "=":
+			return v.filter(attr), nil
+		case "!=":
+			return trie.Not(v.filter(attr)), nil
+		}
+		return nil, p.errorf(opTok, "operator %s is not supported for cidr", opTok.text)
+	}
+
+	max := attr.maxValue()
+	switch opTok.text {
+	case "=":
+		return v.filter(attr), nil
+	case "!=":
+		return trie.Not(v.filter(attr)), nil
+	case "<":
+		if v.value == 0 {
+			return trie.In(attr.name), nil
+		}
+		return trie.Range(attr.name, nil, attr.key(v.value-1)), nil
+	case "<=":
+		return trie.Range(attr.name, nil, attr.key(v.value)), nil
+	case ">":
+		if v.value == max {
+			return trie.In(attr.name), nil
+		}
+		return trie.Range(attr.name, attr.key(v.value+1), nil), nil
+	case ">=":
+		return trie.Range(attr.name, attr.key(v.value), nil), nil
+	}
+
+	return nil, p.errorf(opTok, "unknown operator %s", opTok.text)
+}
+
+// parseStringCond 字符串属性上的比较, 不存在前驱的 < 转换为 <= 并排除自身
+func (p *parser) parseStringCond(attr *queryAttr, opTok token) (trie.Filter, error) {
+	if opTok.text == "~" {
+		return p.parseRegexp(attr)
+	}
+
+	key, err := p.parseString(attr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opTok.text {
+	case "=":
+		return trie.Eq(attr.name, key), nil
+	case "!=":
+		return trie.Not(trie.Eq(attr.name, key)), nil
+	case "<":
+		return trie.And(trie.Range(attr.name, nil, key), trie.Not(trie.Eq(attr.name, key))), nil
+	case "<=":
+		return trie.Range(attr.name, nil, key), nil
+	case ">":
+		// 大于key的最小字符串是key后接0
+		return trie.Range(attr.name, append(key, 0), nil), nil
+	case ">=":
+		return trie.Range(attr.name, key, nil), nil
+	}
+
+	return nil, p.errorf(opTok, "unknown operator %s", opTok.text)
+}
+
+// parseRegexp 正则不做大小写转换, 不区分大小写的属性使用(?i)匹配
+func (p *parser) parseRegexp(attr *queryAttr) (trie.Filter, error) {
+	tok := p.next()
+	if tok.kind != tokenString {
+		return nil, p.errorf(tok, "unexpected %s, expect string for attribute %s", tok, attr.name)
+	}
+
+	expr := tok.text
+	if attr.item.fold {
+		expr = "(?i)" + expr
+	}
+
+	f, err := trie.Regexp(attr.name, expr)
+	if err != nil {
+		return nil, p.errorf(tok, "invalid regexp: %v", err)
+	}
+
+	return f, nil
+}
+
+func (p *parser) parsePrefix(attr *queryAttr) (trie.Filter, error) {
+	if !attr.item.str {
+		return nil, p.errorf(p.peek(), "PREFIX is only supported for string attribute %s", attr.name)
+	}
+
+	key, err := p.parseString(attr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return trie.Prefix(attr.name, key), nil
+}
+
+// parseString 解析字符串并按属性设置转换大小写
+func (p *parser) parseString(attr *queryAttr, prefix bool) ([]byte, error) {
+	tok := p.next()
+	if tok.kind != tokenString {
+		return nil, p.errorf(tok, "unexpected %s, expect string for attribute %s", tok, attr.name)
+	}
+
+	key, err := attr.item.stringKey(tok.text, prefix)
+	if err != nil {
+		return nil, p.errorf(tok, "%v", err)
+	}
+
+	return key, nil
+}
+
+func (p *parser) parseIn(attr *queryAttr) (trie.Filter, error) {
+	if _, err := p.expect(tokenLBracket); err != nil {
+		return nil, err
+	}
+
+	var (
+		keys    [][]byte
+		filters []trie.Filter
+	)
+	for {
+		if attr.item.str {
+			key, err := p.parseString(attr, false)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		} else if v, err := p.parseValue(attr); err != nil {
+			return nil, err
+		} else if v.cidr {
+			filters = append(filters, v.filter(attr))
+		} else {
+			keys = append(keys, attr.key(v.value))
+		}
+
+		tok := p.next()
+		if tok.kind == tokenRBracket {
+			break
+		}
+		if tok.kind != tokenComma {
+			return nil, p.errorf(tok, "unexpected %s, expect ',' or ']'", tok)
+		}
+	}
+
+	if len(filters) == 0 {
+		return trie.In(attr.name, keys...), nil
+	}
+
+	if len(keys) > 0 {
+		filters = append(filters, trie.In(attr.name, keys...))
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return trie.Or(filters...), nil
+}
+
+type queryAttr struct {
+	name string
+	item *attrItem
+}
+
+func (a *queryAttr) maxValue() uint64 {
+	if a.item.byteLen >= 64 {
+		return ^uint64(0)
+	}
+
+	return 1<<a.item.byteLen - 1
+}
+
+func (a *queryAttr) key(v uint64) []byte {
+	return IntXXToBytes(int64(v), a.item.byteLen)
+}
+
+type queryValue struct {
+	value uint64
+	cidr  bool
+	bits  int
+}
+
+func (v *queryValue) filter(attr *queryAttr) trie.Filter {
+	if v.cidr {
+		return trie.CIDR(attr.name, attr.key(v.value), v.bits)
+	}
+
+	return trie.Eq(attr.name, attr.key(v.value))
+}
+
+// parseValue 解析值并检查与属性的类型是否匹配
+func (p *parser) parseValue(attr *queryAttr) (*queryValue, error) {
+	tok := p.next()
+
+	if attr.item.timed {
+		if tok.kind != tokenString {
+			return nil, p.errorf(tok, "unexpected %s, expect RFC3339 time for attribute %s", tok, attr.name)
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, tok.text)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid time %s", tok.text)
+		}
+		return &queryValue{value: timeValue(t)}, nil
+	}
+
+	switch tok.kind {
+	case tokenNumber:
+		v, err := strconv.ParseUint(tok.text, 0, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %s", tok.text)
+		}
+
+		if v > attr.maxValue() {
+			return nil, p.errorf(tok, "%s overflows %d-bit attribute %s", tok.text, attr.item.byteLen, attr.name)
+		}
+		return &queryValue{value: v}, nil
+	case tokenIP, tokenCIDR:
+		if attr.item.byteLen != 32 {
+			return nil, p.errorf(tok, "ip %s used with %d-bit attribute %s", tok.text, attr.item.byteLen, attr.name)
+		}
+
+		text := tok.text
+		bits := 32
+		if tok.kind == tokenCIDR {
+			i := strings.IndexByte(text, '/')
+			n, err := strconv.Atoi(text[i+1:])
+			if err != nil || n < 0 || n > 32 {
+				return nil, p.errorf(tok, "invalid prefix length in %s", tok.text)
+			}
+			text, bits = text[:i], n
+		}
+
+		v, ok := parseIPv4(text)
+		if !ok {
+			return nil, p.errorf(tok, "invalid ip %s", text)
+		}
+
+		if tok.kind == tokenCIDR {
+			return &queryValue{value: v, cidr: true, bits: bits}, nil
+		}
+		return &queryValue{value: v}, nil
+	}
+
+	return nil, p.errorf(tok, "unexpected %s, expect value", tok)
+}
+
+func parseIPv4(text string) (uint64, bool) {
+	parts := strings.Split(text, ".")
+	if len(parts) != 4 {
+		return 0, false
+	}
+
+	var v uint64
+	for _, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return 0, false
+		}
+		v = v<<8 | n
+	}
+
+	return v, true
+}
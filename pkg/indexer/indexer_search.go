@@ -0,0 +1,448 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// Filter 计算满足过滤表达式的value, 按 Plan 生成的查询计划执行
+func (indexer *Indexer) Filter(f trie.Filter) (*vpack.VPack, error) {
+	return indexer.FilterContext(context.Background(), f)
+}
+
+// FilterContext 同 Filter, 遍历trie和合并结果的过程中定期检查ctx;
+// ctx 被取消或超时时返回 ctx.Err(), 取反和求交集时部分结果没有意义, 不返回部分结果
+func (indexer *Indexer) FilterContext(ctx context.Context, f trie.Filter) (*vpack.VPack, error) {
+	plan, err := indexer.Plan(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return indexer.execute(ctx, plan, indexer.all, nil)
+}
+
+// run 执行子结点, step 不为nil时为子结点记录执行情况
+func (indexer *Indexer) run(ctx context.Context, plan *PlanNode, candidates *vpack.VPack, step *ExplainStep) (*vpack.VPack, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if step == nil {
+		return indexer.execute(ctx, plan, candidates, nil)
+	}
+
+	child := newExplainStep(plan)
+	step.Children = append(step.Children, child)
+
+	start := time.Now()
+	pack, err := indexer.execute(ctx, plan, candidates, child)
+	child.finish(pack, start)
+
+	return pack, err
+}
+
+// execute 执行查询计划, candidates 为 StrategyFilter 的候选集, step 不为nil时记录执行情况
+func (indexer *Indexer) execute(ctx context.Context, plan *PlanNode, candidates *vpack.VPack, step *ExplainStep) (*vpack.VPack, error) {
+	var stats *trie.ScanStats
+	if step != nil {
+		stats = &step.Scan
+	}
+
+	switch plan.Strategy {
+	case StrategyPoint, StrategyRange:
+		f := plan.Filter.(*trie.AttrFilter)
+		item := indexer.attrItems[f.Attr]
+		if plan.Strategy == StrategyRange {
+			// 取反和三态的value不能按前缀查找, 逐个检查范围中是否有满足约束的取值
+			pack, err := item.trie.FilterQueryContext(ctx, f.Pred, stats)
+			if err != nil {
+				return nil, err
+			}
+			pack.Merge(item.any)
+
+			width := int(item.byteLen / 8)
+			negated, err := indexer.valuesMatching(ctx, item.not, func(md *Metadata) bool {
+				return matchNegated(md.attrs[f.Attr], f.Pred, width)
+			})
+			if err != nil {
+				return nil, err
+			}
+			pack.Merge(negated)
+
+			ternary, err := indexer.valuesMatching(ctx, item.ternaryValues, func(md *Metadata) bool {
+				return matchTernary(md.ternary[f.Attr], f.Pred, width)
+			})
+			if err != nil {
+				return nil, err
+			}
+			pack.Merge(ternary)
+			return pack, nil
+		}
+
+		var keys [][]byte
+		switch pred := f.Pred.(type) {
+		case *trie.EqPredicate:
+			keys = [][]byte{pred.Key}
+		case *trie.InPredicate:
+			keys = pred.Keys
+		}
+
+		pack := vpack.NewValuePack(0, 0)
+		for i, key := range keys {
+			if i%contextCheckInterval == contextCheckInterval-1 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+
+			if ret := item.trie.LookupStats(key, stats); ret != nil {
+				pack.Merge(ret)
+			}
+			pack.Merge(item.notMatching(key, stats))
+			pack.Merge(item.ternaryMatching(key, stats))
+		}
+
+		// 空的In不包含任何取值, 通配的value也不满足
+		if len(keys) > 0 {
+			pack.Merge(item.any)
+		}
+		return pack, nil
+	case StrategyFilter:
+		if step != nil {
+			step.Candidates = candidates.Count()
+		}
+		return indexer.filterValuesContext(ctx, candidates, plan.Filter)
+	case StrategyNegate:
+		ret, err := indexer.run(ctx, plan.Children[0], indexer.all, step)
+		if err != nil {
+			return nil, err
+		}
+
+		return vpack.Difference(indexer.all, ret), nil
+	case StrategyIntersect:
+		var pack *vpack.VPack
+		for i, child := range plan.Children {
+			base := pack
+			if base == nil {
+				base = indexer.all
+			}
+
+			var (
+				ret *vpack.VPack
+				err error
+			)
+			switch child.Strategy {
+			case StrategyFilter:
+				pack, err = indexer.run(ctx, child, base, step)
+			case StrategyAntiJoin:
+				ret, err = indexer.run(ctx, child, base, step)
+				if err == nil {
+					pack = ret
+				}
+			default:
+				ret, err = indexer.run(ctx, child, indexer.all, step)
+				if err == nil {
+					if pack == nil {
+						pack = ret
+					} else {
+						pack = vpack.Intersect(pack, ret)
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if pack.Size() == 0 {
+				if step != nil {
+					step.skip(plan.Children[i+1:])
+				}
+				break
+			}
+		}
+
+		if pack == nil {
+			return indexer.allValues(), nil
+		}
+		return pack, nil
+	case StrategyAntiJoin:
+		ret, err := indexer.run(ctx, plan.Children[0], indexer.all, step)
+		if err != nil {
+			return nil, err
+		}
+
+		return vpack.Difference(candidates, ret), nil
+	case StrategyUnion:
+		pack := vpack.NewValuePack(0, 0)
+		for _, child := range plan.Children {
+			ret, err := indexer.run(ctx, child, indexer.all, step)
+			if err != nil {
+				return nil, err
+			}
+
+			pack.Merge(ret)
+		}
+
+		return pack, nil
+	}
+
+	return nil, fmt.Errorf("unsupport strategy %s", plan.Strategy)
+}
+
+// contextCheckInterval 逐个处理key或候选value时每隔多少个检查一次Context
+const contextCheckInterval = 1024
+
+// filterValues 使用正排信息过滤候选value
+func (indexer *Indexer) filterValues(candidates *vpack.VPack, f trie.Filter) *vpack.VPack {
+	pack, _ := indexer.filterValuesContext(context.Background(), candidates, f)
+	return pack
+}
+
+// filterValuesContext 同 filterValues, ctx 被取消或超时时返回 ctx.Err()
+func (indexer *Indexer) filterValuesContext(ctx context.Context, candidates *vpack.VPack, f trie.Filter) (*vpack.VPack, error) {
+	pack := vpack.NewValuePack(0, 0)
+	for i, v := range candidates.Unpack() {
+		if i%contextCheckInterval == contextCheckInterval-1 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		if md, ok := indexer.metadataTable[int64(v)]; ok && indexer.matchMetadata(md, f) {
+			pack.Add(v)
+		}
+	}
+
+	return pack, nil
+}
+
+// valuesMatching values中正排信息满足match的value
+func (indexer *Indexer) valuesMatching(ctx context.Context, values *vpack.VPack, match func(md *Metadata) bool) (*vpack.VPack, error) {
+	pack := vpack.NewValuePack(0, 0)
+	for i, v := range values.Unpack() {
+		if i%contextCheckInterval == contextCheckInterval-1 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		if md, ok := indexer.metadataTable[int64(v)]; ok && match(md) {
+			pack.Add(v)
+		}
+	}
+
+	return pack, nil
+}
+
+// matchMetadata 判断value的正排信息是否满足过滤表达式
+func (indexer *Indexer) matchMetadata(md *Metadata, f trie.Filter) bool {
+	switch f := f.(type) {
+	case *trie.AttrFilter:
+		keys, ok := md.attrs[f.Attr]
+		if !ok {
+			return false
+		}
+
+		if keys == nil {
+			in, ok := f.Pred.(*trie.InPredicate)
+			return !ok || len(in.Keys) > 0
+		}
+
+		var width int
+		if item, ok := indexer.attrItems[f.Attr]; ok && item != nil {
+			width = int(item.byteLen / 8)
+		}
+
+		if md.negated[f.Attr] {
+			return matchNegated(keys, f.Pred, width)
+		}
+
+		for _, key := range keys {
+			if f.Pred.Match(key) {
+				return true
+			}
+		}
+		return matchTernary(md.ternary[f.Attr], f.Pred, width)
+	case *trie.AndFilter:
+		for _, sub := range f.Filters {
+			if !indexer.matchMetadata(md, sub) {
+				return false
+			}
+		}
+		return true
+	case *trie.OrFilter:
+		for _, sub := range f.Filters {
+			if indexer.matchMetadata(md, sub) {
+				return true
+			}
+		}
+		return false
+	case *trie.NotFilter:
+		return !indexer.matchMetadata(md, f.Filter)
+	}
+
+	return false
+}
+
+// matchNegated 排除集合之外是否有满足谓词的取值, width 为属性key的字节数
+func matchNegated(keys [][]byte, pred trie.Predicate, width int) bool {
+	var targets [][]byte
+	switch pred := pred.(type) {
+	case *trie.EqPredicate:
+		targets = [][]byte{pred.Key}
+	case *trie.InPredicate:
+		targets = pred.Keys
+	default:
+		s := &keySearch{pred: pred, width: width, budget: keySearchBudget}
+		return s.exists(nil, func(prefix []byte) (bool, bool) {
+			under := false
+			for _, key := range keys {
+				if bytes.HasPrefix(prefix, key) {
+					return true, false
+				}
+				if len(key) > len(prefix) && bytes.HasPrefix(key, prefix) {
+					under = true
+				}
+			}
+
+			// 子树中没有排除前缀时都不被排除
+			return false, !under
+		})
+	}
+
+	for _, target := range targets {
+		excluded := false
+		for _, key := range keys {
+			if bytes.HasPrefix(target, key) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keySearchBudget keySearch 最多访问的前缀数量, 范围、CIDR和前缀谓词部分满足的前缀很少,
+// 超过时按存在处理, 只可能多返回value
+const keySearchBudget = 1 << 14
+
+// keySearch 在长度为width的key中查找满足谓词且满足约束的key
+type keySearch struct {
+	pred   trie.Predicate
+	width  int
+	budget int
+}
+
+// exists 以prefix开头的key中是否有满足谓词和约束的key; check 返回以prefix开头的key是否都不满足约束、
+// 是否一定有满足约束的key. 谓词对子树全部满足且子树中一定有满足约束的key时即存在,
+// 否则只沿谓词部分满足或不能确定的子树向下查找
+func (s *keySearch) exists(prefix []byte, check func(prefix []byte) (none, some bool)) bool {
+	if s.budget--; s.budget < 0 {
+		return true
+	}
+
+	none, some := check(prefix)
+	if none {
+		return false
+	}
+
+	if len(prefix) >= s.width {
+		return s.pred.Match(prefix)
+	}
+
+	switch s.pred.Test(prefix) {
+	case trie.CoverNone:
+		return false
+	case trie.CoverAll:
+		if some {
+			return true
+		}
+	}
+
+	next := make([]byte, len(prefix)+1)
+	copy(next, prefix)
+	for b := 0; b < 256; b++ {
+		next[len(prefix)] = byte(b)
+		if s.exists(next, check) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchTernary 是否有满足三态key的取值满足谓词, width 为属性key的字节数
+func matchTernary(keys [][]byte, pred trie.Predicate, width int) bool {
+	if len(keys) == 0 {
+		return false
+	}
+
+	var targets [][]byte
+	switch pred := pred.(type) {
+	case *trie.EqPredicate:
+		targets = [][]byte{pred.Key}
+	case *trie.InPredicate:
+		targets = pred.Keys
+	default:
+		for _, key := range keys {
+			if ternaryIntersects(key, pred, width) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, target := range targets {
+		for _, key := range keys {
+			if len(key)/2 > len(target) {
+				continue
+			}
+
+			value, mask := trie.ParseTernaryKey(key, len(key)/2)
+			matched := true
+			for i := range value {
+				if target[i]&mask[i] != value[i] {
+					matched = false
+					break
+				}
+			}
+
+			if matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (indexer *Indexer) allValues() *vpack.VPack {
+	pack := vpack.NewValuePack(0, 0)
+	pack.Merge(indexer.all)
+
+	return pack
+}
+
+// ternaryIntersects 是否有满足 v&mask == value 的取值v满足谓词; 前缀与value在mask上一致时,
+// 剩余的字节总能取到满足mask的值, 只需沿谓词部分满足的前缀向下查找与mask一致的字节
+func ternaryIntersects(key []byte, pred trie.Predicate, width int) bool {
+	value, mask := trie.ParseTernaryKey(key, width)
+
+	s := &keySearch{pred: pred, width: width, budget: keySearchBudget}
+	return s.exists(nil, func(prefix []byte) (bool, bool) {
+		if i := len(prefix) - 1; i >= 0 && prefix[i]&mask[i] != value[i] {
+			return true, false
+		}
+		return false, true
+	})
+}
@@ -0,0 +1,644 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// SegmentedIndex 分段的索引: 写入可变的memtable, memtable达到阈值后封存为不可变段,
+// 查询时合并所有段的结果; 删除和更新在旧的段中记录墓碑, 由合并清除
+type SegmentedIndex struct {
+	build        func() (*Indexer, error)
+	memtableSize int
+	policy       CompactionPolicy
+
+	mu       sync.RWMutex
+	memtable *Indexer
+	// spare 更新memtable中已有的value时暂存旧版本, 写入失败时恢复
+	spare *Indexer
+	// 一个value只在一个段或memtable中有效, 段之间没有顺序
+	segments []*segment
+
+	// compactMu 同时只有一个合并在执行
+	compactMu sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type segment struct {
+	indexer *Indexer
+	// deleted 墓碑, 段中已被删除或被更新的value
+	deleted *vpack.VPack
+}
+
+// SegmentInfo 不可变段的概况
+type SegmentInfo struct {
+	// Values 段中的value数量, 包含已删除的
+	Values int
+	// Deleted 已删除的value数量
+	Deleted int
+}
+
+// CompactionPolicy 合并策略, 返回需要合并为一个段的下标, 为空时不合并;
+// 只有一个下标时重写该段, 用于清除墓碑
+type CompactionPolicy interface {
+	Select(segments []SegmentInfo) []int
+}
+
+// TieredPolicy 段的数量超过 MaxSegments 时合并最小的段, 使读放大不超过 MaxSegments+1,
+// MaxSegments 不大于0时不限制段的数量; DeletedRatio 大于0时重写墓碑比例超过该值的段
+type TieredPolicy struct {
+	MaxSegments  int
+	DeletedRatio float64
+}
+
+// DefaultCompactionPolicy 默认的合并策略
+var DefaultCompactionPolicy = &TieredPolicy{MaxSegments: 8, DeletedRatio: 0.5}
+
+func (p *TieredPolicy) Select(segments []SegmentInfo) []int {
+	if p.DeletedRatio > 0 {
+		var ret []int
+		for i, s := range segments {
+			if s.Deleted > 0 && float64(s.Deleted) > p.DeletedRatio*float64(s.Values) {
+				ret = append(ret, i)
+			}
+		}
+		if len(ret) > 0 {
+			return ret
+		}
+	}
+
+	if p.MaxSegments <= 0 || len(segments) <= p.MaxSegments {
+		return nil
+	}
+
+	ret := make([]int, len(segments))
+	for i := range ret {
+		ret[i] = i
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := segments[ret[i]], segments[ret[j]]
+		return a.Values-a.Deleted < b.Values-b.Deleted
+	})
+
+	return ret[:len(segments)-p.MaxSegments+1]
+}
+
+// NewSegmentedIndex 创建分段索引, build 创建memtable和合并后的段, 所有段的属性必须相同;
+// memtableSize 为memtable封存时的value数量, policy 为nil时使用 DefaultCompactionPolicy
+func NewSegmentedIndex(build func() (*Indexer, error), memtableSize int, policy CompactionPolicy) (*SegmentedIndex, error) {
+	if memtableSize <= 0 {
+		return nil, fmt.Errorf("memtable size %d is illegal", memtableSize)
+	}
+
+	if policy == nil {
+		policy = DefaultCompactionPolicy
+	}
+
+	memtable, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	spare, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SegmentedIndex{
+		build:        build,
+		memtableSize: memtableSize,
+		policy:       policy,
+		memtable:     memtable,
+		spare:        spare,
+	}, nil
+}
+
+// Put 写入value, fn 直接在memtable中写入value的所有属性, 只能写入value, 执行期间持有写锁;
+// 成功后在包含旧版本的段中记录墓碑. fn 出错时删除已写入的部分并恢复memtable中的旧版本, 不修改索引
+func (si *SegmentedIndex) Put(value uint64, fn func(indexer *Indexer) error) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	// memtable中的旧版本先移到spare, fn 写入的key不会与旧版本合并
+	_, updated := si.memtable.metadataTable[int64(value)]
+	if updated {
+		if err := si.memtable.copyTo(si.spare, value); err != nil {
+			si.spare.Delete(value)
+			return err
+		}
+		si.memtable.Delete(value)
+	}
+
+	err := fn(si.memtable)
+	if _, ok := si.memtable.metadataTable[int64(value)]; err == nil && !ok {
+		err = fmt.Errorf("value %d is not written", value)
+	}
+
+	if err != nil {
+		si.memtable.Delete(value)
+		if updated {
+			if rerr := si.spare.copyTo(si.memtable, value); rerr != nil {
+				err = fmt.Errorf("%v, restore value %d: %v", err, value, rerr)
+			}
+		}
+		si.spare.Delete(value)
+		return err
+	}
+
+	si.spare.Delete(value)
+	for _, s := range si.segments {
+		if s.indexer.all.Contains(value) {
+			s.deleted.Add(value)
+		}
+	}
+
+	if si.memtable.all.Count() >= si.memtableSize {
+		return si.seal()
+	}
+	return nil
+}
+
+// Delete 删除value, value不存在时返回false
+func (si *SegmentedIndex) Delete(value uint64) bool {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	return si.remove(value)
+}
+
+// remove 从memtable中删除value, 并在包含value的段中记录墓碑
+func (si *SegmentedIndex) remove(value uint64) bool {
+	found := si.memtable.Delete(value)
+	for _, s := range si.segments {
+		if s.indexer.all.Contains(value) && !s.deleted.Contains(value) {
+			s.deleted.Add(value)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// Seal 将memtable封存为不可变段, memtable为空时不处理
+func (si *SegmentedIndex) Seal() error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	return si.seal()
+}
+
+func (si *SegmentedIndex) seal() error {
+	if si.memtable.all.Size() == 0 {
+		return nil
+	}
+
+	memtable, err := si.build()
+	if err != nil {
+		return err
+	}
+
+	// 段不再修改, 统计信息一直有效
+	si.memtable.CollectStats()
+	si.segments = append(si.segments, &segment{indexer: si.memtable, deleted: vpack.NewValuePack(0, 0)})
+	si.memtable = memtable
+
+	return nil
+}
+
+// Filter 计算满足过滤表达式的value, 合并memtable和所有段的结果
+func (si *SegmentedIndex) Filter(f trie.Filter) (*vpack.VPack, error) {
+	return si.FilterContext(context.Background(), f)
+}
+
+// FilterContext 同 Filter, ctx 被取消或超时时返回 ctx.Err()
+func (si *SegmentedIndex) FilterContext(ctx context.Context, f trie.Filter) (*vpack.VPack, error) {
+	return si.union(func(indexer *Indexer) (*vpack.VPack, error) {
+		return indexer.FilterContext(ctx, f)
+	})
+}
+
+// Query 按查询语句查找, 语法见 Indexer.ParseQuery
+func (si *SegmentedIndex) Query(query string) (*vpack.VPack, error) {
+	si.mu.RLock()
+	f, err := si.memtable.ParseQuery(query)
+	si.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return si.Filter(f)
+}
+
+// Match 查找覆盖所有属性取值的value
+func (si *SegmentedIndex) Match(values map[string]uint64) (*vpack.VPack, error) {
+	return si.MatchContext(context.Background(), values)
+}
+
+// MatchContext 同 Match, ctx 被取消或超时时返回 ctx.Err()
+func (si *SegmentedIndex) MatchContext(ctx context.Context, values map[string]uint64) (*vpack.VPack, error) {
+	return si.union(func(indexer *Indexer) (*vpack.VPack, error) {
+		return indexer.MatchContext(ctx, values)
+	})
+}
+
+// MatchBatch 批量匹配, 每个段上相同的属性取值只查找一次
+func (si *SegmentedIndex) MatchBatch(values []map[string]uint64) ([]*vpack.VPack, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	ret := make([]*vpack.VPack, len(values))
+	for i := range ret {
+		ret[i] = vpack.NewValuePack(0, 0)
+	}
+
+	err := si.each(func(indexer *Indexer, deleted *vpack.VPack) error {
+		m := indexer.newMatcher(matchCacheLimit)
+		for i := range values {
+			pack, err := m.match(context.Background(), values[i])
+			if err != nil {
+				return err
+			}
+			ret[i].Merge(without(pack, deleted))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// TopK 按优先级返回pack中最优的k个value; value只在一个段或memtable中有效, 每个段分别取前k个后合并
+func (si *SegmentedIndex) TopK(pack *vpack.VPack, k int) []uint64 {
+	if k <= 0 {
+		return nil
+	}
+
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	var ranked []rankedValue
+	si.each(func(indexer *Indexer, deleted *vpack.VPack) error {
+		sub := vpack.Intersect(pack, without(indexer.all, deleted))
+		for _, v := range indexer.TopK(sub, k) {
+			ranked = append(ranked, rankedValue{value: v, priority: indexer.priorityOf(v)})
+		}
+		return nil
+	})
+
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].better(ranked[j])
+	})
+	if len(ranked) > k {
+		ranked = ranked[:k]
+	}
+
+	var ret []uint64
+	for _, r := range ranked {
+		ret = append(ret, r.value)
+	}
+
+	return ret
+}
+
+// Explain 在memtable和每个段上执行过滤表达式, 没有段时与 Indexer.Explain 相同;
+// 否则每个段的执行情况作为子结点, 根结点的结果为去掉墓碑后的并集
+func (si *SegmentedIndex) Explain(f trie.Filter) (*ExplainStep, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	if len(si.segments) == 0 {
+		return si.memtable.Explain(f)
+	}
+
+	root := &ExplainStep{Filter: f.String(), Strategy: StrategyUnion}
+	start := time.Now()
+
+	ret := vpack.NewValuePack(0, 0)
+	err := si.each(func(indexer *Indexer, deleted *vpack.VPack) error {
+		step, pack, err := indexer.explain(f)
+		if err != nil {
+			return err
+		}
+
+		root.Children = append(root.Children, step)
+		ret.Merge(without(pack, deleted))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	root.finish(ret, start)
+
+	return root, nil
+}
+
+// Overlapping 在memtable和每个段上查找匹配空间与约束相交的value, 按id排序, 见 Indexer.Overlapping
+func (si *SegmentedIndex) Overlapping(constraints map[string]Constraint) ([]Overlap, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	var ret []Overlap
+	err := si.each(func(indexer *Indexer, deleted *vpack.VPack) error {
+		overlaps, err := indexer.Overlapping(constraints)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range overlaps {
+			if deleted == nil || !deleted.Contains(o.ID) {
+				ret = append(ret, o)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+
+	return ret, nil
+}
+
+// metadata value当前有效版本的正排信息
+func (si *SegmentedIndex) metadata(value uint64) (*Metadata, bool) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	if md, ok := si.memtable.metadataTable[int64(value)]; ok {
+		return md, true
+	}
+
+	for _, s := range si.segments {
+		if md, ok := s.indexer.metadataTable[int64(value)]; ok && !s.deleted.Contains(value) {
+			return md, true
+		}
+	}
+
+	return nil, false
+}
+
+// union 在memtable和每个段上执行fn, 去掉段中的墓碑后合并
+func (si *SegmentedIndex) union(fn func(indexer *Indexer) (*vpack.VPack, error)) (*vpack.VPack, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	ret := vpack.NewValuePack(0, 0)
+	err := si.each(func(indexer *Indexer, deleted *vpack.VPack) error {
+		pack, err := fn(indexer)
+		if err != nil {
+			return err
+		}
+
+		ret.Merge(without(pack, deleted))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// each 依次在memtable和每个段上执行fn, deleted 为段中的墓碑, memtable 为nil; 调用时持有锁
+func (si *SegmentedIndex) each(fn func(indexer *Indexer, deleted *vpack.VPack) error) error {
+	if err := fn(si.memtable, nil); err != nil {
+		return err
+	}
+
+	for _, s := range si.segments {
+		if err := fn(s.indexer, s.deleted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// without 去掉pack中的墓碑
+func without(pack, deleted *vpack.VPack) *vpack.VPack {
+	if deleted == nil || deleted.Size() == 0 {
+		return pack
+	}
+
+	return vpack.Difference(pack, deleted)
+}
+
+// Segments 不可变段的概况, 不包含memtable
+func (si *SegmentedIndex) Segments() []SegmentInfo {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	return si.segmentInfos()
+}
+
+func (si *SegmentedIndex) segmentInfos() []SegmentInfo {
+	infos := make([]SegmentInfo, len(si.segments))
+	for i, s := range si.segments {
+		infos[i] = SegmentInfo{Values: s.indexer.all.Count(), Deleted: s.deleted.Count()}
+	}
+
+	return infos
+}
+
+// Compact 按合并策略合并一次, 返回被合并的段数量;
+// 合并期间不阻塞读写, 合并期间产生的墓碑转移到合并后的段中
+func (si *SegmentedIndex) Compact() (int, error) {
+	si.compactMu.Lock()
+	defer si.compactMu.Unlock()
+
+	si.mu.RLock()
+	selected := si.policy.Select(si.segmentInfos())
+	sources := make([]*segment, 0, len(selected))
+	deleted := make([]*vpack.VPack, 0, len(selected))
+	for _, i := range selected {
+		if i < 0 || i >= len(si.segments) {
+			si.mu.RUnlock()
+			return 0, fmt.Errorf("compaction policy selected segment %d out of %d", i, len(si.segments))
+		}
+		sources = append(sources, si.segments[i])
+		deleted = append(deleted, vpack.Union(si.segments[i].deleted))
+	}
+	si.mu.RUnlock()
+
+	if len(sources) == 0 {
+		return 0, nil
+	}
+
+	// 段是不可变的, 不需要持有锁
+	merged, err := si.build()
+	if err != nil {
+		return 0, err
+	}
+	for i, s := range sources {
+		for _, value := range vpack.Difference(s.indexer.all, deleted[i]).Unpack() {
+			if err := s.indexer.copyTo(merged, value); err != nil {
+				return 0, err
+			}
+		}
+	}
+	merged.CollectStats()
+
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	ms := &segment{indexer: merged, deleted: vpack.NewValuePack(0, 0)}
+	for i, s := range sources {
+		ms.deleted.Merge(vpack.Difference(s.deleted, deleted[i]))
+	}
+
+	segments := make([]*segment, 0, len(si.segments)-len(sources)+1)
+	for _, s := range si.segments {
+		if !containsSegment(sources, s) {
+			segments = append(segments, s)
+		}
+	}
+	if merged.all.Size() > 0 {
+		segments = append(segments, ms)
+	}
+	si.segments = segments
+
+	return len(sources), nil
+}
+
+func containsSegment(segments []*segment, s *segment) bool {
+	for _, other := range segments {
+		if other == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StartCompactor 每隔interval在后台按合并策略合并, 直到没有需要合并的段; 出错时等待下一次
+func (si *SegmentedIndex) StartCompactor(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("compaction interval %s is illegal", interval)
+	}
+
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	if si.stop != nil {
+		return errors.New("compactor is already started")
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	si.stop, si.done = stop, done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			for {
+				n, err := si.Compact()
+				if err != nil || n == 0 {
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopCompactor 停止后台合并并等待正在执行的合并结束
+func (si *SegmentedIndex) StopCompactor() {
+	si.mu.Lock()
+	stop, done := si.stop, si.done
+	si.stop, si.done = nil, nil
+	si.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// copyTo 按正排信息将value写入dst, dst 的属性必须与indexer相同
+func (indexer *Indexer) copyTo(dst *Indexer, value uint64) error {
+	md, ok := indexer.metadataTable[int64(value)]
+	if !ok {
+		return fmt.Errorf("value %d is not indexed", value)
+	}
+
+	for attr, keys := range md.attrs {
+		item, ok := dst.attrItems[attr]
+		if !ok || item == nil {
+			return fmt.Errorf("attribute %s is not exist", attr)
+		}
+
+		if keys == nil {
+			if err := dst.AddAttrAny(attr, value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		t := item.trie
+		if md.negated[attr] {
+			t = item.notTrie
+			item.not.Add(value)
+		}
+		for _, key := range keys {
+			if err := t.Put(key, item.tag, value); err != nil {
+				return err
+			}
+			if item.str {
+				item.addStringID(key)
+			}
+
+			dst.addMetadata(attr, key, value)
+		}
+
+		if md.negated[attr] {
+			dmd := dst.metadata(value)
+			if dmd.negated == nil {
+				dmd.negated = make(map[string]bool)
+			}
+			dmd.negated[attr] = true
+		}
+	}
+
+	for attr, keys := range md.ternary {
+		item, ok := dst.attrItems[attr]
+		if !ok || item == nil {
+			return fmt.Errorf("attribute %s is not exist", attr)
+		}
+
+		for _, key := range keys {
+			if err := item.ternaryTrie.Put(key, item.tag, value); err != nil {
+				return err
+			}
+			item.ternaryValues.Add(value)
+
+			dst.addTernaryMetadata(attr, key, value)
+		}
+	}
+
+	return dst.SetPriority(value, md.priority)
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// heavyKeyNum 每个属性记录的高频key数量
+const heavyKeyNum = 8
+
+// KeyStats 单个key的posting数量
+type KeyStats struct {
+	Key      []byte
+	Postings int
+}
+
+// AttrStats 属性trie的统计信息, 由 CollectStats 生成; 属性被写入或删除后过期,
+// 查询计划改为直接查询trie, 直到再次收集
+type AttrStats struct {
+	// Keys key的数量
+	Keys int
+	// Postings 所有key的value数量之和
+	Postings int
+	// HeavyKeys posting最多的key, 按posting数量降序
+	HeavyKeys []KeyStats
+	// Histogram 按key首字节划分的256个桶中的posting数量
+	Histogram [256]int
+	// Any 该属性通配的value数量, 不计入Postings
+	Any int
+}
+
+// avgPostings 平均每个key的posting数量, 向上取整
+func (s *AttrStats) avgPostings() int {
+	if s.Keys == 0 {
+		return 0
+	}
+
+	return (s.Postings + s.Keys - 1) / s.Keys
+}
+
+// postings 估计单个key的posting数量, 高频key使用精确值, 其余使用平均值
+func (s *AttrStats) postings(key []byte) int {
+	for _, heavy := range s.HeavyKeys {
+		if bytes.Equal(heavy.Key, key) {
+			return heavy.Postings
+		}
+	}
+
+	avg := s.avgPostings()
+	if n := len(s.HeavyKeys); n == heavyKeyNum && avg > s.HeavyKeys[n-1].Postings {
+		// 不在高频key中的key不会超过最小的高频key
+		avg = s.HeavyKeys[n-1].Postings
+	}
+
+	return avg
+}
+
+// CollectStats 重新收集所有属性的统计信息
+func (indexer *Indexer) CollectStats() {
+	for _, item := range indexer.attrItems {
+		item.stats = collectStats(item)
+	}
+}
+
+// Stats 返回属性的统计信息, 尚未收集时先收集
+func (indexer *Indexer) Stats(attr string) (*AttrStats, error) {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil {
+		return nil, fmt.Errorf("not exsit the attr item %s in the tree", attr)
+	}
+
+	if item.stats == nil {
+		item.stats = collectStats(item)
+	}
+
+	return item.stats, nil
+}
+
+func collectStats(item *attrItem) *AttrStats {
+	stats := &AttrStats{Any: item.any.Count()}
+	item.trie.RangeScan(nil, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+		postings := vals.Count()
+		stats.Keys++
+		stats.Postings += postings
+		stats.Histogram[key[0]] += postings
+
+		stats.addHeavyKey(key, postings)
+		return true
+	})
+
+	return stats
+}
+
+// addHeavyKey 维护按posting数量降序的前 heavyKeyNum 个key
+func (s *AttrStats) addHeavyKey(key []byte, postings int) {
+	n := len(s.HeavyKeys)
+	if n == heavyKeyNum && s.HeavyKeys[n-1].Postings >= postings {
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool {
+		return s.HeavyKeys[i].Postings < postings
+	})
+
+	if n < heavyKeyNum {
+		s.HeavyKeys = append(s.HeavyKeys, KeyStats{})
+	}
+	copy(s.HeavyKeys[i+1:], s.HeavyKeys[i:])
+	s.HeavyKeys[i] = KeyStats{Key: append([]byte{}, key...), Postings: postings}
+}
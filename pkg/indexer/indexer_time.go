@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anbien/polyer/pkg/trie"
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// timeValue 时间的有序编码: 纳秒时间戳翻转符号位, 1970年之前的时间也保持顺序,
+// 可表示的范围与 time.Time.UnixNano 相同
+func timeValue(t time.Time) uint64 {
+	return uint64(t.UnixNano()) ^ 1<<63
+}
+
+// EncodeTime 时间在属性trie中的key, 按字节比较的顺序与时间顺序一致
+func EncodeTime(t time.Time) []byte {
+	return IntXXToBytes(int64(timeValue(t)), 64)
+}
+
+// AddTimeAttrItem 添加时间属性, 按 EncodeTime 编码为64位的key
+func (b *builder) AddTimeAttrItem(attr string, tag uint32) *builder {
+	b.AddAttrItem(attr, 64, tag)
+	if item, ok := b.indexer.attrItems[attr]; ok && !item.str {
+		item.timed = true
+	}
+
+	return b
+}
+
+// AddAttrTime 在时间属性上索引value
+func (indexer *Indexer) AddAttrTime(attr string, t time.Time, value uint64) error {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil {
+		return errors.New("not exsit the attr item in the tree")
+	}
+
+	if !item.timed {
+		return fmt.Errorf("attribute %s is not a time attribute", attr)
+	}
+
+	key := EncodeTime(t)
+	if indexer.wildcard(attr, value) {
+		return nil
+	}
+
+	if err := item.trie.Put(key, item.tag, value); err != nil {
+		return err
+	}
+
+	indexer.addMetadata(attr, key, value)
+	return nil
+}
+
+// TimeRange 时间属性在[from, to]中的过滤表达式
+func (indexer *Indexer) TimeRange(attr string, from, to time.Time) (trie.Filter, error) {
+	item, ok := indexer.attrItems[attr]
+	if !ok || item == nil || !item.timed {
+		return nil, fmt.Errorf("attribute %s is not a time attribute", attr)
+	}
+
+	return trie.Range(attr, EncodeTime(from), EncodeTime(to)), nil
+}
+
+// TimeIndex 按时间分桶的索引, 每个桶是一个独立的Indexer, 保留期之外的数据整桶丢弃,
+// 不需要逐个删除value
+type TimeIndex struct {
+	attr   string
+	bucket time.Duration
+	build  func() (*Indexer, error)
+
+	mu sync.RWMutex
+	// 按起始时间排序
+	buckets []*timeBucket
+}
+
+type timeBucket struct {
+	start   time.Time
+	indexer *Indexer
+}
+
+// NewTimeIndex 创建按bucket分桶的索引, build 创建每个桶的Indexer, 其中attr必须是时间属性
+func NewTimeIndex(attr string, bucket time.Duration, build func() (*Indexer, error)) (*TimeIndex, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket duration %s is illegal", bucket)
+	}
+
+	indexer, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	if item, ok := indexer.attrItems[attr]; !ok || item == nil || !item.timed {
+		return nil, fmt.Errorf("attribute %s is not a time attribute", attr)
+	}
+
+	return &TimeIndex{attr: attr, bucket: bucket, build: build}, nil
+}
+
+// Add 将value写入t所在的桶, fn 不为nil时在同一个桶中写入value的其他属性, 执行期间持有写锁;
+// 出错时从桶中删除value, 不会留下只有时间的记录
+func (ti *TimeIndex) Add(t time.Time, value uint64, fn func(indexer *Indexer) error) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	b, err := ti.bucketOf(t)
+	if err != nil {
+		return err
+	}
+
+	if err := b.indexer.AddAttrTime(ti.attr, t, value); err != nil {
+		return err
+	}
+
+	if fn != nil {
+		if err := fn(b.indexer); err != nil {
+			b.indexer.Delete(value)
+			return err
+		}
+	}
+	return nil
+}
+
+func (ti *TimeIndex) bucketOf(t time.Time) (*timeBucket, error) {
+	start := t.Truncate(ti.bucket)
+
+	i := sort.Search(len(ti.buckets), func(i int) bool {
+		return !ti.buckets[i].start.Before(start)
+	})
+	if i < len(ti.buckets) && ti.buckets[i].start.Equal(start) {
+		return ti.buckets[i], nil
+	}
+
+	indexer, err := ti.build()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &timeBucket{start: start, indexer: indexer}
+	ti.buckets = append(ti.buckets, nil)
+	copy(ti.buckets[i+1:], ti.buckets[i:])
+	ti.buckets[i] = b
+
+	return b, nil
+}
+
+// Search 查找时间在[from, to]中且满足过滤表达式的value, f 为nil时只按时间查找;
+// 只访问与时间范围相交的桶, 完全落在范围内的桶不需要再按时间过滤
+func (ti *TimeIndex) Search(from, to time.Time, f trie.Filter) (*vpack.VPack, error) {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	ret := vpack.NewValuePack(0, 0)
+	for _, b := range ti.buckets {
+		end := b.start.Add(ti.bucket)
+		if !end.After(from) || b.start.After(to) {
+			continue
+		}
+
+		var filters []trie.Filter
+		if b.start.Before(from) || end.Add(-1).After(to) {
+			timeFilter, err := b.indexer.TimeRange(ti.attr, from, to)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, timeFilter)
+		}
+		if f != nil {
+			filters = append(filters, f)
+		}
+
+		var (
+			pack *vpack.VPack
+			err  error
+		)
+		if len(filters) == 0 {
+			pack = b.indexer.allValues()
+		} else {
+			pack, err = b.indexer.Filter(trie.And(filters...))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Merge(pack)
+	}
+
+	return ret, nil
+}
+
+// SearchLast 查找最近d时间内满足过滤表达式的value
+func (ti *TimeIndex) SearchLast(d time.Duration, f trie.Filter) (*vpack.VPack, error) {
+	now := time.Now()
+	return ti.Search(now.Add(-d), now, f)
+}
+
+// Expire 丢弃结束时间不晚于before的桶, 返回丢弃的桶数量
+func (ti *TimeIndex) Expire(before time.Time) int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	n := 0
+	for n < len(ti.buckets) && !ti.buckets[n].start.Add(ti.bucket).After(before) {
+		n++
+	}
+
+	// 清空被移走的位置, 使丢弃的桶可以被回收
+	m := copy(ti.buckets, ti.buckets[n:])
+	for i := m; i < len(ti.buckets); i++ {
+		ti.buckets[i] = nil
+	}
+	ti.buckets = ti.buckets[:m]
+
+	return n
+}
+
+// Buckets 当前的桶数量
+func (ti *TimeIndex) Buckets() int {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	return len(ti.buckets)
+}
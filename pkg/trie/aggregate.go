@@ -0,0 +1,163 @@
+package trie
+
+import "errors"
+
+// updateCount 更新从根到key路径上所有结点的聚合信息, 不维护聚合信息时不处理
+func (pt *PTrie) updateCount(key []byte, keyDelta, valueDelta int) {
+	if !pt.aggregates {
+		return
+	}
+
+	pt.root.keyCount += keyDelta
+	pt.root.valueCount += valueDelta
+
+	chunk := pt.root.next
+	remainKey := key
+	for chunk != nil && len(remainKey) > 0 {
+		node := chunk.find(remainKey[0])
+		if node == nil {
+			return
+		}
+
+		node.keyCount += keyDelta
+		node.valueCount += valueDelta
+
+		if len(remainKey) < len(node.key) {
+			return
+		}
+		remainKey = remainKey[len(node.key):]
+		chunk = node.next
+	}
+}
+
+// PrefixCount 统计以prefix为前缀的key和value的数量, 只沿prefix下降一次
+func (pt *PTrie) PrefixCount(prefix []byte) (int, int) {
+	if len(prefix) == 0 {
+		return pt.subtreeCount(&pt.root)
+	}
+
+	chunk := pt.root.next
+	remainKey := prefix
+	for chunk != nil {
+		node := chunk.find(remainKey[0])
+		if node == nil {
+			return 0, 0
+		}
+
+		if len(remainKey) <= len(node.key) {
+			if hasPrefix(node.key, remainKey) {
+				return pt.subtreeCount(node)
+			}
+			return 0, 0
+		}
+
+		if !hasPrefix(remainKey, node.key) {
+			return 0, 0
+		}
+
+		remainKey = remainKey[len(node.key):]
+		chunk = node.next
+	}
+
+	return 0, 0
+}
+
+// KeyCount 统计[start, end]范围内key的数量, start/end为nil表示不限边界
+func (pt *PTrie) KeyCount(start, end []byte) (int, error) {
+	keys, _, err := pt.count(start, end)
+	return keys, err
+}
+
+// RangeCount 统计[start, end]范围内value的数量, start/end为nil表示不限边界
+func (pt *PTrie) RangeCount(start, end []byte) (int, error) {
+	_, values, err := pt.count(start, end)
+	return values, err
+}
+
+func (pt *PTrie) count(start, end []byte) (int, int, error) {
+	if start != nil && end != nil && compare(start, end) > 0 {
+		return 0, 0, errors.New("不是合法的范围")
+	}
+
+	if start == nil && end == nil {
+		keys, values := pt.subtreeCount(&pt.root)
+		return keys, values, nil
+	}
+
+	c := &counter{trie: pt, start: start, end: end}
+	c.countChunk(pt.root.next, make([]byte, 0, 16))
+
+	return c.keys, c.values, nil
+}
+
+// subtreeCount 子树(包含自身)中key和value的数量, 不维护聚合信息时遍历子树
+func (pt *PTrie) subtreeCount(node *PTrieNode) (int, int) {
+	if pt.aggregates {
+		return node.keyCount, node.valueCount
+	}
+
+	var keys, values int
+	if node.vPack != nil && node.vPack.Size() > 0 {
+		keys++
+		values += node.vPack.Count()
+	}
+	if node.next != nil {
+		node.next.each(false, func(child *PTrieNode) bool {
+			k, v := pt.subtreeCount(child)
+			keys += k
+			values += v
+			return true
+		})
+	}
+
+	return keys, values
+}
+
+// counter 只下降到边界结点, 被范围完全覆盖的子树直接使用聚合值
+type counter struct {
+	trie  *PTrie
+	start []byte
+	end   []byte
+
+	keys   int
+	values int
+}
+
+func (c *counter) countChunk(chunk *PTrieChunk, prefix []byte) {
+	if chunk == nil {
+		return
+	}
+
+	chunk.each(false, func(node *PTrieNode) bool {
+		key := append(prefix, node.key...)
+
+		if c.start != nil && compare(key, c.start) < 0 && !hasPrefix(c.start, key) {
+			return true
+		}
+
+		if c.end != nil && compare(key, c.end) > 0 {
+			// 结点有序, 后面的结点都超出了范围
+			return false
+		}
+
+		lowCovered := c.start == nil || compare(key, c.start) >= 0
+		highCovered := c.end == nil || (compare(key, c.end) < 0 && !hasPrefix(c.end, key))
+		if lowCovered && highCovered {
+			keys, values := c.trie.subtreeCount(node)
+			c.keys += keys
+			c.values += values
+			return true
+		}
+
+		if lowCovered && node.vPack != nil && node.vPack.Size() > 0 {
+			c.keys++
+			c.values += node.vPack.Count()
+		}
+
+		if c.end == nil || compare(key, c.end) < 0 {
+			c.countChunk(node.next, key)
+		}
+
+		return true
+	})
+}
@@ -1,54 +1,350 @@
 package trie
 
 import (
-	"math"
+	"math/bits"
 
 	"github.com/anbien/polyer/pkg/vpack"
 )
 
+// chunk 参考ART(Adaptive Radix Tree), 根据扇出在以下布局之间升级/降级:
+//
+//	node4/node16: nodes 按首字节有序, 二分查找
+//	node48:       nodes 为槽位, index[首字节] = 槽位 + 1
+//	node256:      nodes 按首字节直接寻址
+const (
+	node4   = 4
+	node16  = 16
+	node48  = 48
+	node256 = 256
+
+	// 降级的阈值比升级低一些, 避免在边界上反复转换
+	shrink256 = 40
+	shrink48  = 12
+)
+
 type PTrieChunk struct {
 	nodes []*PTrieNode
 
-	parent *PTrieNode
+	// 只有node48使用
+	index *[256]uint8
+
+	// node48/node256 使用, 记录存在的首字节, 用于直接计算排名
+	present *[4]uint64
 }
 
 func NewTrieChunk() *PTrieChunk {
 	return &PTrieChunk{}
 }
 
-// AddNode 添加结点
+func (tc *PTrieChunk) kind() int {
+	switch {
+	case tc.index != nil:
+		return node48
+	case len(tc.nodes) == node256:
+		return node256
+	case len(tc.nodes) > node4:
+		return node16
+	default:
+		return node4
+	}
+}
+
+// Len 子结点的数量
+func (tc *PTrieChunk) Len() int {
+	if tc.kind() != node256 {
+		return len(tc.nodes)
+	}
+
+	return tc.rank(node256)
+}
+
+// AddNode 添加结点, 首字节相同的结点已存在时合并value
 func (tc *PTrieChunk) AddNode(node *PTrieNode) error {
-	// 先查找Node的插入位置
-	offset := tc.location(node.key)
+	tmp := tc.find(node.key[0])
+	if tmp == nil {
+		tc.InsertNode(node)
+		return nil
+	}
+
+	pack, err := vpack.Merge(node.vPack, tmp.vPack)
+	if err != nil {
+		return err
+	}
+
+	tmp.vPack = pack
+	return nil
+}
+
+// InsertNode 插入结点, 首字节相同的结点会被替换
+func (tc *PTrieChunk) InsertNode(node *PTrieNode) {
+	b := node.key[0]
+
+	switch tc.kind() {
+	case node256:
+		tc.nodes[b] = node
+		tc.present[b>>6] |= 1 << (b & 63)
+		return
+	case node48:
+		if slot := tc.index[b]; slot > 0 {
+			tc.nodes[slot-1] = node
+			return
+		}
+
+		if len(tc.nodes) < node48 {
+			tc.appendSlot(node)
+			tc.index[b] = uint8(len(tc.nodes))
+		} else {
+			tc.grow()
+			tc.nodes[b] = node
+		}
+		tc.present[b>>6] |= 1 << (b & 63)
+		return
+	}
+
+	offset := tc.search(b)
 	if offset >= 0 {
-		tmp := tc.nodes[offset]
-		pack, err := vpack.Merge(node.vPack, tmp.vPack)
-		if err != nil {
-			return err
+		tc.nodes[offset] = node
+		return
+	}
+
+	if len(tc.nodes) >= node16 {
+		tc.grow()
+		tc.InsertNode(node)
+		return
+	}
+
+	// 指定位置插入节点
+	offset = -offset - 1
+	tc.nodes = append(tc.nodes, nil)
+	copy(tc.nodes[offset+1:], tc.nodes[offset:])
+	tc.nodes[offset] = node
+}
+
+// RemoveNode 删除首字节为b的结点
+func (tc *PTrieChunk) RemoveNode(b byte) {
+	switch tc.kind() {
+	case node256:
+		tc.nodes[b] = nil
+		tc.present[b>>6] &^= 1 << (b & 63)
+		if tc.Len() <= shrink256 {
+			tc.shrink()
+		}
+		return
+	case node48:
+		slot := tc.index[b]
+		if slot == 0 {
+			return
+		}
+
+		// 用最后一个槽位填补空洞, 保持槽位紧凑
+		last := len(tc.nodes) - 1
+		if int(slot-1) != last {
+			moved := tc.nodes[last]
+			tc.nodes[slot-1] = moved
+			tc.index[moved.key[0]] = slot
+		}
+		tc.nodes[last] = nil
+		tc.nodes = tc.nodes[:last]
+		tc.index[b] = 0
+		tc.present[b>>6] &^= 1 << (b & 63)
+
+		if len(tc.nodes) <= shrink48 {
+			tc.shrink()
+		}
+		return
+	}
+
+	offset := tc.search(b)
+	if offset < 0 {
+		return
+	}
+
+	copy(tc.nodes[offset:], tc.nodes[offset+1:])
+	tc.nodes[len(tc.nodes)-1] = nil
+	tc.nodes = tc.nodes[:len(tc.nodes)-1]
+}
+
+// appendSlot node48追加槽位, 容量最多增长到node48
+func (tc *PTrieChunk) appendSlot(node *PTrieNode) {
+	if len(tc.nodes) == cap(tc.nodes) {
+		size := cap(tc.nodes) * 2
+		if size > node48 {
+			size = node48
+		}
+
+		nodes := make([]*PTrieNode, len(tc.nodes), size)
+		copy(nodes, tc.nodes)
+		tc.nodes = nodes
+	}
+
+	tc.nodes = append(tc.nodes, node)
+}
+
+// grow 升级为更大的布局
+func (tc *PTrieChunk) grow() {
+	switch tc.kind() {
+	case node48:
+		nodes := make([]*PTrieNode, node256)
+		for _, node := range tc.nodes {
+			nodes[node.key[0]] = node
 		}
 
-		tmp.vPack = pack
+		tc.nodes = nodes
+		tc.index = nil
+	default:
+		// node16 的有序数组直接作为 node48 的槽位
+		tc.index = &[256]uint8{}
+		tc.present = &[4]uint64{}
+		for i, node := range tc.nodes {
+			b := node.key[0]
+			tc.index[b] = uint8(i + 1)
+			tc.present[b>>6] |= 1 << (b & 63)
+		}
+	}
+}
+
+// shrink 降级为更小的布局, 结点按首字节有序排列
+func (tc *PTrieChunk) shrink() {
+	nodes := make([]*PTrieNode, 0, tc.Len())
+	tc.each(false, func(node *PTrieNode) bool {
+		nodes = append(nodes, node)
+		return true
+	})
+
+	// node256 降级为 node48 时存在的首字节不变, 沿用present
+	if tc.kind() == node256 && len(nodes) > node16 {
+		tc.index = &[256]uint8{}
+		for i, node := range nodes {
+			tc.index[node.key[0]] = uint8(i + 1)
+		}
+	} else {
+		tc.index = nil
+		tc.present = nil
+	}
+
+	tc.nodes = nodes
+}
+
+// find 查找首字节为b的结点
+func (tc *PTrieChunk) find(b byte) *PTrieNode {
+	switch tc.kind() {
+	case node256:
+		return tc.nodes[b]
+	case node48:
+		if slot := tc.index[b]; slot > 0 {
+			return tc.nodes[slot-1]
+		}
+		return nil
 	}
 
-	index := int(math.Abs(float64(offset)) - 1)
-	tc.InsertNode(index, node)
+	if offset := tc.search(b); offset >= 0 {
+		return tc.nodes[offset]
+	}
 
 	return nil
 }
 
-// 指定位置插入节点
-func (tc *PTrieChunk) InsertNode(offset int, node *PTrieNode) {
-	if len(tc.nodes) == 0 || len(tc.nodes)-1 <= offset {
-		tc.nodes = append(tc.nodes, node)
-		return
+// each 按首字节顺序遍历子结点, fn返回false时终止
+func (tc *PTrieChunk) each(reverse bool, fn func(node *PTrieNode) bool) bool {
+	if tc.kind() == node48 {
+		for i := 0; i < node256; i++ {
+			b := i
+			if reverse {
+				b = node256 - 1 - i
+			}
+
+			if slot := tc.index[b]; slot > 0 && !fn(tc.nodes[slot-1]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	n := len(tc.nodes)
+	for i := 0; i < n; i++ {
+		index := i
+		if reverse {
+			index = n - 1 - i
+		}
+
+		if node := tc.nodes[index]; node != nil && !fn(node) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nodeAt 返回按首字节排序后的第i个结点
+func (tc *PTrieChunk) nodeAt(i int) *PTrieNode {
+	if kind := tc.kind(); kind == node4 || kind == node16 {
+		return tc.nodes[i]
 	}
 
-	rear := append([]*PTrieNode{}, tc.nodes[offset:]...)
-	tc.nodes = append(tc.nodes[:offset], node)
-	tc.nodes = append(tc.nodes, rear...)
+	b, ok := tc.selectByte(i)
+	if !ok {
+		return nil
+	}
+
+	return tc.find(b)
 }
 
+// location 返回key在chunk中的排名, 不存在时返回 -(插入位置 + 1)
 func (tc *PTrieChunk) location(key []byte) int {
+	b := key[0]
+
+	switch tc.kind() {
+	case node256, node48:
+		rank := tc.rank(int(b))
+		if tc.present[b>>6]&(1<<(b&63)) == 0 {
+			return -(rank + 1)
+		}
+		return rank
+	}
+
+	return tc.search(b)
+}
+
+// rank 首字节小于b的结点数量, 只用于node48/node256
+func (tc *PTrieChunk) rank(b int) int {
+	var n int
+	for w := 0; w < b>>6; w++ {
+		n += bits.OnesCount64(tc.present[w])
+	}
+
+	if b < node256 && b&63 != 0 {
+		n += bits.OnesCount64(tc.present[b>>6] & (1<<uint(b&63) - 1))
+	}
+
+	return n
+}
+
+// selectByte 排名为i的结点的首字节, 只用于node48/node256
+func (tc *PTrieChunk) selectByte(i int) (byte, bool) {
+	if i < 0 {
+		return 0, false
+	}
+
+	for w, word := range tc.present {
+		n := bits.OnesCount64(word)
+		if i >= n {
+			i -= n
+			continue
+		}
+
+		// 清除低位的i个1, 剩余的最低位即为所求
+		for ; i > 0; i-- {
+			word &= word - 1
+		}
+		return byte(w<<6 + bits.TrailingZeros64(word)), true
+	}
+
+	return 0, false
+}
+
+// search 在有序布局中二分查找首字节
+func (tc *PTrieChunk) search(b byte) int {
 	if len(tc.nodes) == 0 {
 		return -1
 	}
@@ -56,12 +352,12 @@ func (tc *PTrieChunk) location(key []byte) int {
 	low := 0
 	high := len(tc.nodes) - 1
 	for low <= high {
-		mid := low + (high-low) >> 1
+		mid := low + (high-low)>>1
 		tmp := tc.nodes[mid]
-		if key[0] == tmp.key[0] {
+		if b == tmp.key[0] {
 			return mid
 		}
-		if key[0] < tmp.key[0] {
+		if b < tmp.key[0] {
 			high = mid - 1
 		} else {
 			low = mid + 1
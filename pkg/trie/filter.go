@@ -1 +1,413 @@
 package trie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// Cover 谓词对以某个前缀开头的所有key的判定结果, 用于遍历时剪枝
+type Cover int
+
+const (
+	// CoverNone 都不满足, 整棵子树可以跳过
+	CoverNone Cover = iota
+	// CoverPart 部分满足, 需要继续下降
+	CoverPart
+	// CoverAll 都满足, 整棵子树直接收集
+	CoverAll
+)
+
+// Predicate 作用于单个属性key的谓词
+type Predicate interface {
+	// Match 判断key是否满足
+	Match(key []byte) bool
+	// Test 判断以prefix为前缀的key是否满足
+	Test(prefix []byte) Cover
+	String() string
+}
+
+// EqPredicate key等于Key
+type EqPredicate struct {
+	Key []byte
+}
+
+func (p *EqPredicate) Match(key []byte) bool {
+	return bytes.Equal(key, p.Key)
+}
+
+func (p *EqPredicate) Test(prefix []byte) Cover {
+	if hasPrefix(p.Key, prefix) {
+		return CoverPart
+	}
+
+	return CoverNone
+}
+
+func (p *EqPredicate) String() string {
+	return fmt.Sprintf("= %x", p.Key)
+}
+
+// InPredicate key属于Keys中的某一个, Keys 有序
+type InPredicate struct {
+	Keys [][]byte
+}
+
+func (p *InPredicate) Match(key []byte) bool {
+	i := sort.Search(len(p.Keys), func(i int) bool {
+		return compare(p.Keys[i], key) >= 0
+	})
+
+	return i < len(p.Keys) && bytes.Equal(p.Keys[i], key)
+}
+
+func (p *InPredicate) Test(prefix []byte) Cover {
+	// 以prefix为前缀的key在有序数组中是连续的
+	i := sort.Search(len(p.Keys), func(i int) bool {
+		return compare(p.Keys[i], prefix) >= 0
+	})
+
+	if i < len(p.Keys) && hasPrefix(p.Keys[i], prefix) {
+		return CoverPart
+	}
+
+	return CoverNone
+}
+
+func (p *InPredicate) String() string {
+	keys := make([]string, 0, len(p.Keys))
+	for _, key := range p.Keys {
+		keys = append(keys, fmt.Sprintf("%x", key))
+	}
+
+	return fmt.Sprintf("in [%s]", strings.Join(keys, ", "))
+}
+
+// RangePredicate key属于[Start, End], Start/End 为nil表示不限边界
+type RangePredicate struct {
+	Start []byte
+	End   []byte
+}
+
+func (p *RangePredicate) Match(key []byte) bool {
+	if p.Start != nil && compare(key, p.Start) < 0 {
+		return false
+	}
+
+	return p.End == nil || compare(key, p.End) <= 0
+}
+
+func (p *RangePredicate) Test(prefix []byte) Cover {
+	if p.End != nil && compare(prefix, p.End) > 0 {
+		return CoverNone
+	}
+
+	if p.Start != nil && compare(prefix, p.Start) < 0 {
+		if !hasPrefix(p.Start, prefix) {
+			return CoverNone
+		}
+		return CoverPart
+	}
+
+	if p.End == nil || (compare(prefix, p.End) < 0 && !hasPrefix(p.End, prefix)) {
+		return CoverAll
+	}
+
+	return CoverPart
+}
+
+func (p *RangePredicate) String() string {
+	return fmt.Sprintf("in [%x, %x]", p.Start, p.End)
+}
+
+// PrefixPredicate key以Prefix开头
+type PrefixPredicate struct {
+	Prefix []byte
+}
+
+func (p *PrefixPredicate) Match(key []byte) bool {
+	return hasPrefix(key, p.Prefix)
+}
+
+func (p *PrefixPredicate) Test(prefix []byte) Cover {
+	if hasPrefix(prefix, p.Prefix) {
+		return CoverAll
+	}
+
+	if hasPrefix(p.Prefix, prefix) {
+		return CoverPart
+	}
+
+	return CoverNone
+}
+
+func (p *PrefixPredicate) String() string {
+	return fmt.Sprintf("prefix %x", p.Prefix)
+}
+
+// CIDRPredicate key的前Bits位与IP相同
+type CIDRPredicate struct {
+	IP   []byte
+	Bits int
+}
+
+func (p *CIDRPredicate) Match(key []byte) bool {
+	return len(key)*8 >= p.Bits && bitsEqual(key, p.IP, p.Bits)
+}
+
+func (p *CIDRPredicate) Test(prefix []byte) Cover {
+	if len(prefix)*8 >= p.Bits {
+		if bitsEqual(prefix, p.IP, p.Bits) {
+			return CoverAll
+		}
+		return CoverNone
+	}
+
+	if bitsEqual(prefix, p.IP, len(prefix)*8) {
+		return CoverPart
+	}
+
+	return CoverNone
+}
+
+func (p *CIDRPredicate) String() string {
+	return fmt.Sprintf("in %x/%d", p.IP, p.Bits)
+}
+
+// bitsEqual 比较a和b的前n位是否相同
+func bitsEqual(a, b []byte, n int) bool {
+	full := n / 8
+	if len(a) < full || len(b) < full || !bytes.Equal(a[:full], b[:full]) {
+		return false
+	}
+
+	rest := uint(n % 8)
+	if rest == 0 {
+		return true
+	}
+
+	if len(a) <= full || len(b) <= full {
+		return false
+	}
+
+	mask := byte(0xff) << (8 - rest)
+	return a[full]&mask == b[full]&mask
+}
+
+// Filter 多个属性上的过滤表达式
+type Filter interface {
+	String() string
+}
+
+// AttrFilter 单个属性上的谓词
+type AttrFilter struct {
+	Attr string
+	Pred Predicate
+}
+
+func (f *AttrFilter) String() string {
+	return fmt.Sprintf("%s %s", f.Attr, f.Pred)
+}
+
+// AndFilter 所有子表达式都满足
+type AndFilter struct {
+	Filters []Filter
+}
+
+func (f *AndFilter) String() string {
+	return joinFilters(f.Filters, " and ")
+}
+
+// OrFilter 任意一个子表达式满足
+type OrFilter struct {
+	Filters []Filter
+}
+
+func (f *OrFilter) String() string {
+	return joinFilters(f.Filters, " or ")
+}
+
+// NotFilter 子表达式不满足
+type NotFilter struct {
+	Filter Filter
+}
+
+func (f *NotFilter) String() string {
+	return fmt.Sprintf("not (%s)", f.Filter)
+}
+
+func joinFilters(filters []Filter, sep string) string {
+	items := make([]string, 0, len(filters))
+	for _, f := range filters {
+		items = append(items, "("+f.String()+")")
+	}
+
+	return strings.Join(items, sep)
+}
+
+func Eq(attr string, key []byte) Filter {
+	return &AttrFilter{Attr: attr, Pred: &EqPredicate{Key: key}}
+}
+
+func In(attr string, keys ...[]byte) Filter {
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compare(sorted[i], sorted[j]) < 0
+	})
+
+	return &AttrFilter{Attr: attr, Pred: &InPredicate{Keys: sorted}}
+}
+
+func Range(attr string, start, end []byte) Filter {
+	return &AttrFilter{Attr: attr, Pred: &RangePredicate{Start: start, End: end}}
+}
+
+func Prefix(attr string, prefix []byte) Filter {
+	return &AttrFilter{Attr: attr, Pred: &PrefixPredicate{Prefix: prefix}}
+}
+
+func CIDR(attr string, ip []byte, bits int) Filter {
+	return &AttrFilter{Attr: attr, Pred: &CIDRPredicate{IP: ip, Bits: bits}}
+}
+
+func Not(f Filter) Filter {
+	return &NotFilter{Filter: f}
+}
+
+func And(filters ...Filter) Filter {
+	return &AndFilter{Filters: filters}
+}
+
+func Or(filters ...Filter) Filter {
+	return &OrFilter{Filters: filters}
+}
+
+// FilterScan 按key顺序访问满足谓词的key, 不满足的子树在遍历时被剪掉
+// opts 中的范围选项(ExcludeStart/ExcludeEnd)不起作用
+func (pt *PTrie) FilterScan(pred Predicate, opts *ScanOptions, fn ScanFunc) error {
+	if fn == nil {
+		return errors.New("scan func is nil")
+	}
+
+	if err := contextErr(opts); err != nil {
+		return err
+	}
+
+	s := &scanner{fn: fn}
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	s.filterChunk(pt.root.next, pred, make([]byte, 0, 16))
+
+	return s.err
+}
+
+// FilterQuery 查找满足谓词的所有key的value, stats 不为nil时记录访问情况
+func (pt *PTrie) FilterQuery(pred Predicate, stats *ScanStats) *vpack.VPack {
+	newPack, _ := pt.FilterQueryContext(context.Background(), pred, stats)
+	return newPack
+}
+
+// FilterQueryContext 同 FilterQuery, ctx 被取消或超时时返回已经找到的部分value和 ctx.Err()
+func (pt *PTrie) FilterQueryContext(ctx context.Context, pred Predicate, stats *ScanStats) (*vpack.VPack, error) {
+	newPack := &vpack.VPack{}
+	err := pt.FilterScan(pred, &ScanOptions{Stats: stats, Context: ctx}, func(key []byte, vals *vpack.VPack) bool {
+		newPack.Merge(vals)
+		return true
+	})
+
+	return newPack, err
+}
+
+func (s *scanner) filterChunk(chunk *PTrieChunk, pred Predicate, prefix []byte) bool {
+	if chunk == nil {
+		return true
+	}
+
+	if s.opts.Stats != nil {
+		s.opts.Stats.Chunks++
+	}
+
+	return chunk.each(s.opts.Reverse, func(node *PTrieNode) bool {
+		if s.canceled() {
+			return false
+		}
+
+		key := append(prefix, node.key...)
+
+		switch pred.Test(key) {
+		case CoverNone:
+			if s.opts.Stats != nil {
+				s.opts.Stats.Nodes++
+			}
+			return true
+		case CoverAll:
+			return s.scanNode(node, prefix)
+		}
+
+		if s.opts.Stats != nil {
+			s.opts.Stats.Nodes++
+		}
+
+		if !s.opts.Reverse && !s.filterVisit(node, pred, key) {
+			return false
+		}
+
+		if !s.filterChunk(node.next, pred, key) {
+			return false
+		}
+
+		return !s.opts.Reverse || s.filterVisit(node, pred, key)
+	})
+}
+
+func (s *scanner) filterVisit(node *PTrieNode, pred Predicate, key []byte) bool {
+	if node.vPack == nil || node.vPack.Size() == 0 || !pred.Match(key) {
+		return true
+	}
+
+	return s.emit(key, node.vPack)
+}
+
+// FilterCount 统计满足谓词的key和value数量, 被谓词完全覆盖的子树直接使用聚合值
+func (pt *PTrie) FilterCount(pred Predicate) (int, int) {
+	c := &counter{trie: pt}
+	c.filterChunk(pt.root.next, pred, make([]byte, 0, 16))
+
+	return c.keys, c.values
+}
+
+func (c *counter) filterChunk(chunk *PTrieChunk, pred Predicate, prefix []byte) {
+	if chunk == nil {
+		return
+	}
+
+	chunk.each(false, func(node *PTrieNode) bool {
+		key := append(prefix, node.key...)
+
+		switch pred.Test(key) {
+		case CoverNone:
+			return true
+		case CoverAll:
+			keys, values := c.trie.subtreeCount(node)
+			c.keys += keys
+			c.values += values
+			return true
+		}
+
+		if node.vPack != nil && node.vPack.Size() > 0 && pred.Match(key) {
+			c.keys++
+			c.values += node.vPack.Count()
+		}
+
+		c.filterChunk(node.next, pred, key)
+		return true
+	})
+}
@@ -0,0 +1,400 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unsafe"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// FrozenTrie 只读的紧凑Trie
+// 结点按层序连续存放在数组中, 同一个结点的子结点相邻且按首字节有序, 使用下标代替指针;
+// 所有结点的key存放在同一个arena中, 所有value的打包数据存放在另一个arena中.
+// 数组中不包含指针, GC无需扫描, 序列化后的数据可以直接mmap使用
+type FrozenTrie struct {
+	nodes  []frozenNode
+	values []vpack.PackUint64
+	keys   []byte
+
+	// 从序列化数据加载时引用原始数据, 保证其不被回收
+	data []byte
+}
+
+type frozenNode struct {
+	keyOff   uint32
+	keyLen   uint32
+	child    uint32
+	childNum uint32
+	valueOff uint32
+	valueLen uint32
+	tag      uint32
+	reserved uint32
+}
+
+const (
+	frozenMagic      = "PTRZ"
+	frozenVersion    = 1
+	frozenHeaderSize = 32
+	frozenNodeSize   = int(unsafe.Sizeof(frozenNode{}))
+	frozenValueSize  = int(unsafe.Sizeof(vpack.PackUint64(0)))
+
+	// 直接引用数据时切片的最大长度, 数组类型在32位平台上不能超过2GB, 超过时拷贝
+	maxCastNodes  = math.MaxInt32 / frozenNodeSize
+	maxCastValues = math.MaxInt32 / frozenValueSize
+)
+
+// Freeze 将PTrie转换为只读的FrozenTrie, 转换后两者互不影响;
+// 结点数量、key和value的总长度超过uint32时返回错误
+func (pt *PTrie) Freeze() (*FrozenTrie, error) {
+	ft := &FrozenTrie{}
+
+	queue := []*PTrieNode{&pt.root}
+	ft.nodes = append(ft.nodes, frozenNode{})
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+		fn := &ft.nodes[i]
+
+		if uint64(len(ft.keys))+uint64(len(node.key)) > math.MaxUint32 {
+			return nil, errors.New("frozen trie keys overflow")
+		}
+
+		fn.keyOff = uint32(len(ft.keys))
+		fn.keyLen = uint32(len(node.key))
+		ft.keys = append(ft.keys, node.key...)
+
+		if node.vPack != nil && node.vPack.Size() > 0 {
+			if uint64(len(ft.values))+uint64(node.vPack.Size()) > math.MaxUint32 {
+				return nil, errors.New("frozen trie values overflow")
+			}
+
+			fn.valueOff = uint32(len(ft.values))
+			fn.valueLen = uint32(node.vPack.Size())
+			fn.tag = node.vPack.Tag()
+			ft.values = append(ft.values, node.vPack.Data()...)
+		}
+
+		if node.next == nil {
+			continue
+		}
+
+		if uint64(len(queue))+uint64(node.next.Len()) > math.MaxUint32 {
+			return nil, errors.New("frozen trie nodes overflow")
+		}
+
+		fn.child = uint32(len(queue))
+		node.next.each(false, func(child *PTrieNode) bool {
+			queue = append(queue, child)
+			ft.nodes = append(ft.nodes, frozenNode{})
+			return true
+		})
+		// append可能导致扩容, fn不能再使用
+		ft.nodes[i].childNum = uint32(len(queue)) - ft.nodes[i].child
+	}
+
+	return ft, nil
+}
+
+func (ft *FrozenTrie) key(fn *frozenNode) []byte {
+	return ft.keys[fn.keyOff : fn.keyOff+fn.keyLen]
+}
+
+func (ft *FrozenTrie) vPack(fn *frozenNode) *vpack.VPack {
+	if fn.valueLen == 0 {
+		return nil
+	}
+
+	end := fn.valueOff + fn.valueLen
+	return vpack.NewValuePackFrom(fn.tag, ft.values[fn.valueOff:end:end])
+}
+
+// find 在子结点中二分查找首字节为b的结点
+func (ft *FrozenTrie) find(parent *frozenNode, b byte) *frozenNode {
+	low := int(parent.child)
+	high := low + int(parent.childNum) - 1
+	for low <= high {
+		mid := low + (high-low)>>1
+		tmp := &ft.nodes[mid]
+		first := ft.keys[tmp.keyOff]
+		if b == first {
+			return tmp
+		}
+		if b < first {
+			high = mid - 1
+		} else {
+			low = mid + 1
+		}
+	}
+
+	return nil
+}
+
+// Get 根据key查找
+func (ft *FrozenTrie) Get(key []byte) []uint64 {
+	if len(ft.nodes) == 0 || len(key) == 0 {
+		return nil
+	}
+
+	node := &ft.nodes[0]
+	remainKey := key
+	for len(remainKey) > 0 {
+		node = ft.find(node, remainKey[0])
+		if node == nil || !hasPrefix(remainKey, ft.key(node)) {
+			return nil
+		}
+
+		remainKey = remainKey[node.keyLen:]
+	}
+
+	if pack := ft.vPack(node); pack != nil {
+		return pack.Unpack()
+	}
+
+	return nil
+}
+
+// RangeScan 与 PTrie.RangeScan 语义相同
+func (ft *FrozenTrie) RangeScan(start, end []byte, opts *ScanOptions, fn ScanFunc) error {
+	if fn == nil {
+		return errors.New("scan func is nil")
+	}
+
+	if start != nil && end != nil && compare(start, end) > 0 {
+		return errors.New("不是合法的范围")
+	}
+
+	s := &scanner{
+		start: start,
+		end:   end,
+		fn:    fn,
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	if len(ft.nodes) > 0 {
+		ft.scanChildren(s, &ft.nodes[0], make([]byte, 0, 16))
+	}
+
+	return nil
+}
+
+func (ft *FrozenTrie) scanChildren(s *scanner, parent *frozenNode, prefix []byte) bool {
+	n := int(parent.childNum)
+	for i := 0; i < n; i++ {
+		index := i
+		if s.opts.Reverse {
+			index = n - 1 - i
+		}
+
+		if !ft.scanNode(s, &ft.nodes[int(parent.child)+index], prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ft *FrozenTrie) scanNode(s *scanner, node *frozenNode, prefix []byte) bool {
+	key := append(prefix, ft.key(node)...)
+	if s.skip(key) {
+		return true
+	}
+
+	if !s.opts.Reverse && !ft.visit(s, node, key) {
+		return false
+	}
+
+	if s.descend(key) && !ft.scanChildren(s, node, key) {
+		return false
+	}
+
+	if s.opts.Reverse && !ft.visit(s, node, key) {
+		return false
+	}
+
+	return true
+}
+
+func (ft *FrozenTrie) visit(s *scanner, node *frozenNode, key []byte) bool {
+	if node.valueLen == 0 || !s.inRange(key) {
+		return true
+	}
+
+	return s.emit(key, ft.vPack(node))
+}
+
+// RangeQuery 根据key范围查找
+func (ft *FrozenTrie) RangeQuery(start, end []byte) ([]uint64, error) {
+	newPack := &vpack.VPack{}
+	err := ft.RangeScan(start, end, nil, func(key []byte, vals *vpack.VPack) bool {
+		newPack.Merge(vals)
+		return true
+	})
+
+	return newPack.Unpack(), err
+}
+
+// PrefixQuery 查找以prefix为前缀的所有key的value
+func (ft *FrozenTrie) PrefixQuery(prefix []byte) []uint64 {
+	newPack := &vpack.VPack{}
+	ft.RangeScan(prefix, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+		if !hasPrefix(key, prefix) {
+			return false
+		}
+
+		newPack.Merge(vals)
+		return true
+	})
+
+	return newPack.Unpack()
+}
+
+// WriteTo 序列化, 格式(小端):
+//
+//	header: magic(4) version(4) nodeNum(4) reserved(4) valueNum(8) keyLen(8)
+//	nodes:  nodeNum * frozenNode
+//	values: valueNum * PackUint64
+//	keys:   keyLen bytes
+//
+// header和node都是8字节对齐的, 加载时可以直接引用数据而不需要拷贝
+func (ft *FrozenTrie) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, frozenHeaderSize)
+	copy(header, frozenMagic)
+	binary.LittleEndian.PutUint32(header[4:], frozenVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(ft.nodes)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(ft.values)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(ft.keys)))
+
+	n, err := w.Write(header)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, data := range []interface{}{ft.nodes, ft.values} {
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return total, err
+		}
+		total += int64(binary.Size(data))
+	}
+
+	n, err = w.Write(ft.keys)
+	total += int64(n)
+
+	return total, err
+}
+
+// LoadFrozenTrie 从序列化数据加载FrozenTrie, 每个结点的key、子结点和value的范围都会被校验,
+// 损坏或截断的数据返回错误.
+// 在小端机器上且data按8字节对齐时(例如mmap得到的内存)直接引用data, 不做拷贝,
+// 此时调用方需要保证data在FrozenTrie使用期间有效且不被修改
+func LoadFrozenTrie(data []byte) (*FrozenTrie, error) {
+	if len(data) < frozenHeaderSize || string(data[:4]) != frozenMagic {
+		return nil, errors.New("not a frozen trie")
+	}
+
+	if version := binary.LittleEndian.Uint32(data[4:]); version != frozenVersion {
+		return nil, fmt.Errorf("unsupported frozen trie version %d", version)
+	}
+
+	nodeNum := uint64(binary.LittleEndian.Uint32(data[8:]))
+	valueNum := binary.LittleEndian.Uint64(data[16:])
+	keyLen := binary.LittleEndian.Uint64(data[24:])
+
+	// 先与数据长度比较, 避免乘法和加法溢出
+	size := uint64(len(data))
+	if valueNum > size/uint64(frozenValueSize) || keyLen > size {
+		return nil, errors.New("frozen trie data is truncated")
+	}
+
+	nodeEnd := uint64(frozenHeaderSize) + nodeNum*uint64(frozenNodeSize)
+	valueEnd := nodeEnd + valueNum*uint64(frozenValueSize)
+	if valueEnd+keyLen != size {
+		return nil, errors.New("frozen trie data is truncated")
+	}
+
+	ft := &FrozenTrie{
+		keys: data[valueEnd:],
+		data: data,
+	}
+
+	nodeData := data[frozenHeaderSize:nodeEnd]
+	valueData := data[nodeEnd:valueEnd]
+	if nativeLittleEndian() && uintptr(unsafe.Pointer(&data[0]))%8 == 0 &&
+		nodeNum <= uint64(maxCastNodes) && valueNum <= uint64(maxCastValues) {
+		if nodeNum > 0 {
+			ft.nodes = (*[maxCastNodes]frozenNode)(unsafe.Pointer(&nodeData[0]))[:nodeNum:nodeNum]
+		}
+		if valueNum > 0 {
+			ft.values = (*[maxCastValues]vpack.PackUint64)(unsafe.Pointer(&valueData[0]))[:valueNum:valueNum]
+		}
+	} else {
+		ft.nodes = make([]frozenNode, nodeNum)
+		ft.values = make([]vpack.PackUint64, valueNum)
+		if err := binary.Read(bytes.NewReader(nodeData), binary.LittleEndian, ft.nodes); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(valueData), binary.LittleEndian, ft.values); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ft.validate(); err != nil {
+		return nil, err
+	}
+
+	return ft, nil
+}
+
+// validate 校验每个结点引用的范围: key和value不越界, 非根结点的key不为空,
+// 子结点位于父结点之后(层序, 保证遍历不会成环)且按首字节严格递增
+func (ft *FrozenTrie) validate() error {
+	keyNum := uint64(len(ft.keys))
+	valueNum := uint64(len(ft.values))
+	nodeNum := uint64(len(ft.nodes))
+
+	for i := range ft.nodes {
+		fn := &ft.nodes[i]
+		if uint64(fn.keyOff)+uint64(fn.keyLen) > keyNum {
+			return fmt.Errorf("frozen trie node %d key is out of range", i)
+		}
+
+		if i > 0 && fn.keyLen == 0 {
+			return fmt.Errorf("frozen trie node %d key is empty", i)
+		}
+
+		if uint64(fn.valueOff)+uint64(fn.valueLen) > valueNum {
+			return fmt.Errorf("frozen trie node %d value is out of range", i)
+		}
+
+		if fn.childNum == 0 {
+			continue
+		}
+
+		if uint64(fn.child) <= uint64(i) || uint64(fn.child)+uint64(fn.childNum) > nodeNum {
+			return fmt.Errorf("frozen trie node %d children are out of range", i)
+		}
+	}
+
+	// 子结点的key已校验不为空
+	for i := range ft.nodes {
+		fn := &ft.nodes[i]
+		for c := fn.child + 1; c < fn.child+fn.childNum; c++ {
+			if ft.keys[ft.nodes[c-1].keyOff] >= ft.keys[ft.nodes[c].keyOff] {
+				return fmt.Errorf("frozen trie node %d children are not sorted", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func nativeLittleEndian() bool {
+	var x uint16 = 1
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,145 @@
+package trie
+
+import (
+	"sort"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// FuzzyMatch 模糊查找的结果, Distance 为与查找key的编辑距离
+type FuzzyMatch struct {
+	Key      []byte
+	Distance int
+	Values   *vpack.VPack
+}
+
+// fuzzy 按字节计算Levenshtein距离, 每下降一个字节由上一行推出新的一行,
+// 一行中的最小值超过 bound 时整棵子树都不可能满足
+type fuzzy struct {
+	key      []byte
+	maxEdits int
+	limit    int
+	matches  []FuzzyMatch
+}
+
+// FuzzySearch 查找与key的编辑距离不超过maxEdits的key, 编辑距离按字节计算;
+// 结果按距离排序, 距离相同时按key排序, limit 大于0时最多返回limit个
+func (pt *PTrie) FuzzySearch(key []byte, maxEdits int, limit int) []FuzzyMatch {
+	if maxEdits < 0 {
+		return nil
+	}
+
+	f := &fuzzy{key: key, maxEdits: maxEdits, limit: limit}
+
+	row := make([]int, len(key)+1)
+	for i := range row {
+		row[i] = i
+	}
+	f.searchChunk(pt.root.next, row, make([]byte, 0, 16))
+
+	if limit <= 0 {
+		sort.Slice(f.matches, func(i, j int) bool {
+			if f.matches[i].Distance != f.matches[j].Distance {
+				return f.matches[i].Distance < f.matches[j].Distance
+			}
+			return compare(f.matches[i].Key, f.matches[j].Key) < 0
+		})
+	}
+
+	return f.matches
+}
+
+// bound 还能进入结果的最大距离. 按key升序遍历, 结果已有limit个时,
+// 之后的key只有距离小于最差的结果才能替换它, 为负数时遍历可以结束
+func (f *fuzzy) bound() int {
+	if f.limit > 0 && len(f.matches) == f.limit {
+		return f.matches[f.limit-1].Distance - 1
+	}
+
+	return f.maxEdits
+}
+
+// add limit 大于0时按距离有序插入并只保留前limit个, 距离相同时先遍历到的key更小, 排在前面
+func (f *fuzzy) add(m FuzzyMatch) {
+	if f.limit <= 0 {
+		f.matches = append(f.matches, m)
+		return
+	}
+
+	i := sort.Search(len(f.matches), func(i int) bool {
+		return f.matches[i].Distance > m.Distance
+	})
+	if i == f.limit {
+		return
+	}
+
+	if len(f.matches) < f.limit {
+		f.matches = append(f.matches, FuzzyMatch{})
+	}
+	copy(f.matches[i+1:], f.matches[i:])
+	f.matches[i] = m
+}
+
+// searchChunk 返回false时遍历结束
+func (f *fuzzy) searchChunk(chunk *PTrieChunk, row []int, prefix []byte) bool {
+	if chunk == nil {
+		return true
+	}
+
+	return chunk.each(false, func(node *PTrieNode) bool {
+		cur := row
+		for _, b := range node.key {
+			var min int
+			cur, min = f.next(cur, b)
+			if min > f.bound() {
+				return true
+			}
+		}
+
+		key := append(prefix, node.key...)
+		if dist := cur[len(f.key)]; dist <= f.bound() && node.vPack != nil && node.vPack.Size() > 0 {
+			values := vpack.NewValuePack(0, 0)
+			values.Merge(node.vPack)
+
+			f.add(FuzzyMatch{
+				Key:      append([]byte(nil), key...),
+				Distance: dist,
+				Values:   values,
+			})
+		}
+
+		if f.bound() < 0 {
+			return false
+		}
+
+		return f.searchChunk(node.next, cur, key)
+	})
+}
+
+// next 由前缀对应的一行推出追加字节b之后的一行, 同时返回新一行的最小值
+func (f *fuzzy) next(row []int, b byte) ([]int, int) {
+	cur := make([]int, len(row))
+	cur[0] = row[0] + 1
+
+	min := cur[0]
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if f.key[i-1] == b {
+			cost = 0
+		}
+
+		cur[i] = row[i-1] + cost
+		if v := row[i] + 1; v < cur[i] {
+			cur[i] = v
+		}
+		if v := cur[i-1] + 1; v < cur[i] {
+			cur[i] = v
+		}
+
+		if cur[i] < min {
+			min = cur[i]
+		}
+	}
+
+	return cur, min
+}
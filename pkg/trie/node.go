@@ -8,6 +8,10 @@ type PTrieNode struct {
 	next *PTrieChunk
 
 	vPack *vpack.VPack
+
+	// 子树(包含自身)的聚合信息: key的数量以及value的数量
+	keyCount   int
+	valueCount int
 }
 
 func NewPTrieNode() *PTrieNode {
@@ -22,7 +26,8 @@ func (pn *PTrieNode) SetKey(key []byte) {
 // 将value存储到结点中
 func (pn *PTrieNode) Add(tag uint32, value uint64) {
 	if pn.vPack == nil {
-		pn.vPack = vpack.NewValuePack(tag, 0)
+		// 大部分结点只有少量value, 按需增长
+		pn.vPack = vpack.NewValuePack(tag, 1)
 	}
 
 	pn.vPack.Add(value)
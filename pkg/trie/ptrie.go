@@ -1,15 +1,17 @@
 package trie
 
 import (
+	"context"
 	"errors"
-	"log"
-	"math"
 
 	"github.com/anbien/polyer/pkg/vpack"
 )
 
 type PTrie struct {
 	root PTrieNode
+
+	// aggregates 是否在写入和删除时维护子树的聚合信息
+	aggregates bool
 }
 
 func NewTrie() *PTrie {
@@ -18,23 +20,39 @@ func NewTrie() *PTrie {
 	return trie
 }
 
+// NewTrieWithAggregates 创建维护子树聚合信息的trie, 统计数量时被完全覆盖的子树不需要遍历;
+// 每次写入和删除需要更新路径上所有结点, 写多读少时使用 NewTrie
+func NewTrieWithAggregates() *PTrie {
+	trie := NewTrie()
+	trie.aggregates = true
+	return trie
+}
+
 func (pt *PTrie) Put(key []byte, tag uint32, value uint64) error {
 	// 找到 value 插入的位置
-	// 1. 如果offset >= 0，说明找到了具体的插入节点(offset指向的节点), chunk都不为空
-	//    1.1 如果 remainKey 不为空，则需要分裂插入节点(offset指向的节点)
-	//    1.2 如果 remainKey 为空，则直接value加入到插入节点(offset指向的节点)
-	// 2. 如果offset < 0, 说明需要新建节点插入到该位置
+	// 1. 如果node不为空，说明找到了具体的插入节点, chunk都不为空
+	//    1.1 如果 remainKey 不为空，则需要分裂插入节点
+	//    1.2 如果 remainKey 为空，则直接value加入到插入节点
+	// 2. 如果node为空, 说明需要新建节点插入到该chunk
 	//    2.1 新建节点加入到chunk
-	chunk, offset, remainKey := pt.location2(key)
+	chunk, node, remainKey := pt.location2(key)
 	if chunk == nil {
 		return errors.New("the trie is error")
 	}
 
-	if offset >= 0 {
-		node := chunk.nodes[offset]
+	if node != nil {
 		if remainKey == nil {
+			if node.vPack != nil && node.vPack.Contains(value) {
+				return nil
+			}
+
 			// 将之插入到node中
+			var keyDelta = 0
+			if node.vPack == nil || node.vPack.Size() == 0 {
+				keyDelta = 1
+			}
 			node.Add(tag, value)
+			pt.updateCount(key, keyDelta, 1)
 			return nil
 		}
 
@@ -42,6 +60,13 @@ func (pt *PTrie) Put(key []byte, tag uint32, value uint64) error {
 		prefixOffset := node.PrefixOffset(remainKey)
 		splitChunk := splitNode(node, prefixOffset)
 
+		// key是结点key的前缀, 分裂后的结点就是插入节点
+		if prefixOffset+1 == len(remainKey) {
+			node.Add(tag, value)
+			pt.updateCount(key, 1, 1)
+			return nil
+		}
+
 		newNode := NewPTrieNode()
 		newNode.SetKey(remainKey[prefixOffset+1:])
 		newNode.Add(tag, value)
@@ -51,328 +76,178 @@ func (pt *PTrie) Put(key []byte, tag uint32, value uint64) error {
 		newNode.SetKey(remainKey)
 		newNode.Add(tag, value)
 
-		index := int(math.Abs(float64(offset)) - 1)
-		chunk.InsertNode(index, newNode)
+		chunk.InsertNode(newNode)
 	}
+
+	pt.updateCount(key, 1, 1)
 	return nil
 }
 
-// Get 根据key查找
-func (pt *PTrie) Get(key []byte) []uint64 {
-	chunk, offset, remainKey := pt.location2(key)
-	if remainKey != nil || offset < 0 || chunk == nil {
-		return nil
-	}
+// Delete 删除key下的value, 返回value是否存在
+func (pt *PTrie) Delete(key []byte, value uint64) bool {
+	var path []*PTrieNode
 
-	node := chunk.nodes[offset]
+	chunk := pt.root.next
+	remainKey := key
+	for chunk != nil && len(remainKey) > 0 {
+		node := chunk.find(remainKey[0])
+		if node == nil || !hasPrefix(remainKey, node.key) {
+			return false
+		}
 
-	return node.vPack.Unpack()
-}
+		path = append(path, node)
+		remainKey = remainKey[len(node.key):]
+		chunk = node.next
+	}
 
-// RangeQuery 根据key范围查找
-func (pt *PTrie) RangeQuery(start, end []byte) ([]uint64, error) {
-	ret := compare(start, end)
-	if ret > 0 {
-		return nil, errors.New("不是合法的范围")
+	if len(remainKey) > 0 || len(path) == 0 {
+		return false
 	}
 
-	if ret == 0 {
-		return pt.Get(start), nil
+	node := path[len(path)-1]
+	if node.vPack == nil || !node.vPack.Remove(value) {
+		return false
 	}
 
-	// 先找左边界
-	leftBound := pt.LeftBound(start)
+	var keyDelta = 0
+	if node.vPack.Size() == 0 {
+		keyDelta = -1
+	}
+	pt.updateCount(key, keyDelta, -1)
 
-	rightBound := pt.RightBound(end)
+	pt.shrink(path)
 
-	return pt.rangeQuery(leftBound, rightBound), nil
+	return true
 }
 
-func compare(start, end []byte) int {
-	var i = 0
-	for ; i < len(start) && i < len(end); i++ {
-		if start[i] < end[i] {
-			return -1
-		} else if start[i] > end[i] {
-			return 1
+// shrink 自底向上删除空结点, 并合并只有一个子结点的空结点
+func (pt *PTrie) shrink(path []*PTrieNode) {
+	for i := len(path) - 1; i >= 0; i-- {
+		node := path[i]
+		if (node.vPack != nil && node.vPack.Size() > 0) || (node.next != nil && node.next.Len() > 0) {
+			mergeChild(node)
+			return
 		}
-	}
-
-	if i < len(start) {
-		return 1
-	}
 
-	if i < len(end) {
-		return -1
+		parent := &pt.root
+		if i > 0 {
+			parent = path[i-1]
+		}
+		parent.next.RemoveNode(node.key[0])
 	}
-
-	return 0
 }
 
-func recordBoundNode(chunk *PTrieChunk, index int, pack *vpack.VPack) {
-	node := chunk.nodes[index]
-
-	if node.vPack == nil || node.vPack.Size() == 0 {
+func mergeChild(node *PTrieNode) {
+	if node.vPack != nil && node.vPack.Size() > 0 {
 		return
 	}
 
-	pack.Merge(node.vPack)
-
-	return
-}
-
-func recordNode(chunk *PTrieChunk, index int, pack *vpack.VPack) {
-	recordBoundNode(chunk, index, pack)
-
-	if chunk.nodes[index].next == nil {
+	if node.next == nil || node.next.Len() != 1 {
 		return
 	}
 
-	chunk = chunk.nodes[index].next
-	for i := 0; i < len(chunk.nodes); i++ {
-		recordRangeNode(chunk, 0, len(chunk.nodes)-1, pack)
-	}
+	child := node.next.nodeAt(0)
+	node.key = append(node.key, child.key...)
+	node.vPack = child.vPack
+	node.next = child.next
 }
 
-func recordRangeNode(chunk *PTrieChunk, start, end int, pack *vpack.VPack) {
-	for i := start; i <= end; i++ {
-		recordNode(chunk, i, pack)
+// Get 根据key查找
+func (pt *PTrie) Get(key []byte) []uint64 {
+	if pack := pt.Lookup(key); pack != nil {
+		return pack.Unpack()
 	}
-}
 
-func (pt *PTrie) rangeQuery(left, right []*BoundNode) []uint64 {
-	newPack := &vpack.VPack{}
+	return nil
+}
 
-	var depth = 0
+// Lookup 根据key查找结点的VPack, 不存在时返回nil; 返回值为结点内部的VPack, 不允许修改
+func (pt *PTrie) Lookup(key []byte) *vpack.VPack {
+	return pt.LookupStats(key, nil)
+}
 
-	for ; depth < len(left) && depth < len(right); depth++ {
-		lNode := left[depth]
-		rNode := right[depth]
+// LookupStats 与 Lookup 相同, stats 不为nil时记录访问的chunk和结点数量
+func (pt *PTrie) LookupStats(key []byte, stats *ScanStats) *vpack.VPack {
+	if len(key) == 0 {
+		return nil
+	}
 
-		// 检查是否分叉了
-		if lNode.chunk != rNode.chunk {
-			break
+	chunk := pt.root.next
+	remainKey := key
+	for chunk != nil {
+		currNode := chunk.find(remainKey[0])
+		if stats != nil {
+			stats.Chunks++
 		}
-
-		// 记录左节点
-		recordBoundNode(lNode.chunk, lNode.offset, newPack)
-		if lNode.offset == rNode.offset {
-			continue
+		if currNode == nil {
+			return nil
 		}
 
-		// 记录右节点
-		recordBoundNode(rNode.chunk, rNode.offset, newPack)
-
-		// 记录中间节点
-		if lNode.offset+1 <= rNode.offset-1 {
-			recordRangeNode(lNode.chunk, lNode.offset+1, rNode.offset-1, newPack)
+		if stats != nil {
+			stats.Nodes++
 		}
-	}
-
-	// 左分叉遍历
-	if depth < len(left) {
-		for _, lNode := range left[depth:] {
-			// 记录左节点
-			recordBoundNode(lNode.chunk, lNode.offset, newPack)
-
-			// 记录中间节点
-			if lNode.offset+1 <= len(lNode.chunk.nodes)-1 {
-				recordRangeNode(lNode.chunk, lNode.offset+1, len(lNode.chunk.nodes)-1, newPack)
-			}
+		if !hasPrefix(remainKey, currNode.key) {
+			return nil
 		}
-	}
 
-	// 有分叉遍历
-	if depth < len(right) {
-		for _, rNode := range right[depth:] {
-			// 记录右节点
-			recordBoundNode(rNode.chunk, rNode.offset, newPack)
-			// 记录中间节点
-			if rNode.offset >= 1 {
-				recordRangeNode(rNode.chunk, 0, rNode.offset-1, newPack)
+		remainKey = remainKey[len(currNode.key):]
+		if len(remainKey) == 0 {
+			if stats != nil && currNode.vPack != nil && currNode.vPack.Size() > 0 {
+				stats.Keys++
 			}
+			return currNode.vPack
 		}
+
+		chunk = currNode.next
 	}
 
-	return newPack.Unpack()
+	return nil
 }
 
-type BoundNode struct {
-	chunk  *PTrieChunk
-	offset int
+// RangeQuery 根据key范围查找
+func (pt *PTrie) RangeQuery(start, end []byte) ([]uint64, error) {
+	return pt.RangeQueryContext(context.Background(), start, end)
 }
 
-func LeftBoundNext(chunk *PTrieChunk, index int, bounds []*BoundNode) []*BoundNode {
-	if len(bounds) == 0 {
-		return bounds[0:0]
-	}
-
-	// 回退到上一层的下一个节点,记录下来
-	for j := len(bounds) - 1; j >= 0; j-- {
-		node := bounds[j]
-		if node.offset+1 < len(chunk.nodes) {
-			node.offset += 1
-			return bounds
-		}
-
-		bounds = bounds[0:j]
+// RangeQueryContext 同 RangeQuery, ctx 被取消或超时时返回已经找到的部分value和 ctx.Err()
+func (pt *PTrie) RangeQueryContext(ctx context.Context, start, end []byte) ([]uint64, error) {
+	ret := compare(start, end)
+	if ret > 0 {
+		return nil, errors.New("不是合法的范围")
 	}
 
-	return bounds
-}
-
-func RightBoundPrev(chunk *PTrieChunk, index int, bounds []*BoundNode) []*BoundNode {
-	if len(bounds) == 0 {
-		return bounds[0:0]
+	if ret == 0 {
+		return pt.Get(start), nil
 	}
 
-	// 回退到上一层的上一个节点,记录下来
-	for j := len(bounds) - 1; j >= 0; j-- {
-		node := bounds[j]
-		if node.offset-1 >= 0 {
-			node.offset -= 1
-			return bounds
-		}
-
-		bounds = bounds[0:j]
-	}
+	newPack := &vpack.VPack{}
+	err := pt.RangeScan(start, end, &ScanOptions{Context: ctx}, func(key []byte, vals *vpack.VPack) bool {
+		newPack.Merge(vals)
+		return true
+	})
 
-	return bounds
+	return newPack.Unpack(), err
 }
 
-func (pt *PTrie) LeftBound(key []byte) []*BoundNode {
-	var bounds = make([]*BoundNode, 0, len(key))
-
-	parent := &pt.root
-	chunk := parent.next
-
-	remainKey := key
-	for chunk != nil {
-		offset := chunk.location(remainKey)
-		if offset < 0 {
-			index := int(math.Abs(float64(offset)) - 1)
-			if index >= len(chunk.nodes)-1 {
-				bounds = LeftBoundNext(chunk, index, bounds)
-			} else {
-				bounds = leftBoundAll(chunk, index, bounds)
-			}
-			return bounds
-		} else {
-			currNode := chunk.nodes[offset]
-			commOffset := currNode.PrefixOffset(remainKey)
-			if len(currNode.key) > commOffset+1 {
-				ret := compare(remainKey[commOffset+1:], currNode.key[commOffset+1:])
-				if ret > 0 && offset >= len(chunk.nodes)-1 {
-					bounds = LeftBoundNext(chunk, offset, bounds)
-				} else {
-					bounds = leftBoundAll(chunk, offset, bounds)
-				}
-				return bounds
-			}
-
-			bounds = append(bounds, &BoundNode{
-				chunk:  chunk,
-				offset: offset,
-			})
-
-			remainKey = remainKey[commOffset+1:]
-			if len(remainKey) == 0 {
-				break
-			}
-
-			parent = currNode
-			chunk = currNode.next
+func compare(start, end []byte) int {
+	var i = 0
+	for ; i < len(start) && i < len(end); i++ {
+		if start[i] < end[i] {
+			return -1
+		} else if start[i] > end[i] {
+			return 1
 		}
 	}
 
-	return bounds
-}
-
-func leftBoundAll(chunk *PTrieChunk, index int, bounds []*BoundNode) []*BoundNode {
-	bounds = append(bounds, &BoundNode{
-		chunk:  chunk,
-		offset: index,
-	})
-
-	node := chunk.nodes[index]
-	for node.next != nil {
-		c := node.next
-		bounds = append(bounds, &BoundNode{
-			chunk:  c,
-			offset: 0,
-		})
-
-		node = c.nodes[0]
-	}
-
-	return bounds
-}
-
-func rightBoundAll(chunk *PTrieChunk, index int, bounds []*BoundNode) []*BoundNode {
-	bounds = append(bounds, &BoundNode{
-		chunk:  chunk,
-		offset: index,
-	})
-
-	node := chunk.nodes[index]
-	for node.next != nil {
-		c := node.next
-		bounds = append(bounds, &BoundNode{
-			chunk:  c,
-			offset: len(c.nodes) - 1,
-		})
-
-		node = c.nodes[len(c.nodes)-1]
+	if i < len(start) {
+		return 1
 	}
 
-	return bounds
-}
-
-func (pt *PTrie) RightBound(key []byte) []*BoundNode {
-	var bounds = make([]*BoundNode, 0, len(key))
-
-	parent := &pt.root
-	chunk := parent.next
-
-	remainKey := key
-	for chunk != nil {
-		offset := chunk.location(remainKey)
-		if offset < 0 {
-			index := int(math.Abs(float64(offset)) - 1)
-			if index == 0 {
-				bounds = RightBoundPrev(chunk, index, bounds)
-			} else {
-				bounds = rightBoundAll(chunk, index-1, bounds)
-			}
-			return bounds
-		} else {
-			currNode := chunk.nodes[offset]
-			commOffset := currNode.PrefixOffset(remainKey)
-			if len(currNode.key) > commOffset+1 {
-				ret := compare(remainKey[commOffset+1:], currNode.key[commOffset+1:])
-				if ret < 0 && offset == 0 {
-					bounds = RightBoundPrev(chunk, offset, bounds)
-				} else {
-					bounds = rightBoundAll(chunk, offset, bounds)
-				}
-				return bounds
-			}
-
-			bounds = append(bounds, &BoundNode{
-				chunk:  chunk,
-				offset: offset,
-			})
-
-			remainKey = remainKey[commOffset+1:]
-			if len(remainKey) == 0 {
-				break
-			}
-			parent = currNode
-			chunk = currNode.next
-		}
+	if i < len(end) {
+		return -1
 	}
 
-	return bounds
+	return 0
 }
 
 func splitNode(node *PTrieNode, splitOffset int) *PTrieChunk {
@@ -382,80 +257,48 @@ func splitNode(node *PTrieNode, splitOffset int) *PTrieChunk {
 	splitNode := NewPTrieNode()
 	splitNode.SetKey(node.key[splitOffset+1:])
 	splitNode.vPack = node.vPack
-	if oldChunk != nil {
-		splitNode.next = oldChunk
-		oldChunk.parent = splitNode
-	}
+	splitNode.keyCount = node.keyCount
+	splitNode.valueCount = node.valueCount
+	splitNode.next = oldChunk
 
 	splitChunk := NewTrieChunk()
 	splitChunk.AddNode(splitNode)
 
 	node.next = splitChunk
-	node.next.parent = node
 	node.SetKey(node.key[0 : splitOffset+1])
 	node.vPack = nil
 
 	return splitChunk
 }
 
-func (pt *PTrie) location(key []byte) (*PTrieNode, *PTrieChunk, int, []byte) {
-	parent := &pt.root
-	chunk := parent.next
-
-	remainKey := key
-	for chunk != nil {
-		offset := chunk.location(remainKey)
-		if offset < 0 {
-			return parent, chunk, offset, remainKey
-		}
-
-		currNode := chunk.nodes[offset]
-		prefixOffset := currNode.PrefixOffset(remainKey)
-		if len(currNode.key) > prefixOffset+1 {
-			return parent, chunk, offset, remainKey
-		}
-
-		remainKey = remainKey[prefixOffset+1:]
-
-		// 找到精确的节点
-		if len(remainKey) == 0 {
-			return parent, chunk, offset, nil
-		}
-
-		parent = currNode
-		chunk = currNode.next
-	}
-
-	// 理论上不应该出现这种场景
-	log.Println("error tree , need check the bug")
-	return parent, nil, -1, remainKey
-}
-
-func (pt *PTrie) location2(key []byte) (*PTrieChunk, int, []byte) {
+func (pt *PTrie) location2(key []byte) (*PTrieChunk, *PTrieNode, []byte) {
 	chunk := pt.root.next
 
 	remainKey := key
 	for chunk != nil {
-		offset := chunk.location(remainKey)
-		if offset < 0 {
-			return chunk, offset, remainKey
+		currNode := chunk.find(remainKey[0])
+		if currNode == nil {
+			return chunk, nil, remainKey
 		}
 
-		currNode := chunk.nodes[offset]
 		prefixOffset := currNode.PrefixOffset(remainKey)
 		if len(currNode.key) > prefixOffset+1 {
-			return chunk, offset, remainKey
+			return chunk, currNode, remainKey
 		}
 
 		remainKey = remainKey[prefixOffset+1:]
 
 		// 找到精确的节点
 		if len(remainKey) == 0 {
-			return chunk, offset, nil
+			return chunk, currNode, nil
 		}
 
+		// key比已有的key长, 在叶子结点下插入
+		if currNode.next == nil {
+			currNode.next = NewTrieChunk()
+		}
 		chunk = currNode.next
 	}
 
-	return chunk, -1, remainKey
+	return chunk, nil, remainKey
 }
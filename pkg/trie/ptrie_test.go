@@ -1,10 +1,19 @@
 package trie
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"math/rand"
+	"regexp"
+	"runtime"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/anbien/polyer/pkg/vpack"
 )
 
 func TestPTrie_Put(t *testing.T) {
@@ -93,3 +102,848 @@ func TestPTrie_RangeQuery(t *testing.T) {
 	//}
 
 }
+
+func TestPTrie_RangeScan(t *testing.T) {
+	trie := NewTrie()
+
+	keys := make(map[uint64]bool)
+	for i := uint64(0); i < 5000; i++ {
+		k := uint64(rand.Uint32() % 100000)
+		keys[k] = true
+
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, k)
+		trie.Put(buf, 1, i+1)
+	}
+
+	var sorted []uint64
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	start := make([]byte, 8)
+	end := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, sorted[10])
+	binary.BigEndian.PutUint64(end, sorted[100])
+
+	// 闭区间升序
+	var got []uint64
+	trie.RangeScan(start, end, nil, func(key []byte, vals *vpack.VPack) bool {
+		got = append(got, binary.BigEndian.Uint64(key))
+		return true
+	})
+	if len(got) != 91 || got[0] != sorted[10] || got[90] != sorted[100] {
+		t.Error("No Pass")
+	}
+
+	// 开区间降序并限制数量
+	got = got[:0]
+	opts := &ScanOptions{ExcludeStart: true, ExcludeEnd: true, Reverse: true, Limit: 5}
+	trie.RangeScan(start, end, opts, func(key []byte, vals *vpack.VPack) bool {
+		got = append(got, binary.BigEndian.Uint64(key))
+		return true
+	})
+	if len(got) != 5 || got[0] != sorted[99] || got[4] != sorted[95] {
+		t.Error("No Pass")
+	}
+
+	// 不限边界, 回调返回false终止
+	got = got[:0]
+	trie.RangeScan(nil, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+		got = append(got, binary.BigEndian.Uint64(key))
+		return len(got) < 3
+	})
+	if len(got) != 3 || got[0] != sorted[0] || got[2] != sorted[2] {
+		t.Error("No Pass")
+	}
+
+	var count int
+	trie.RangeScan(nil, nil, &ScanOptions{Reverse: true}, func(key []byte, vals *vpack.VPack) bool {
+		if binary.BigEndian.Uint64(key) != sorted[len(sorted)-1-count] {
+			t.Error("No Pass")
+			return false
+		}
+		count++
+		return true
+	})
+	if count != len(sorted) {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_Nearest(t *testing.T) {
+	trie := NewTrie()
+
+	for _, k := range []uint64{100, 200, 300, 0x10000} {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, k)
+		trie.Put(buf, 1, k+1)
+	}
+
+	lookup := func(f func([]byte) ([]byte, []uint64), k uint64) uint64 {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, k)
+		key, values := f(buf)
+		if key == nil {
+			return 0
+		}
+		if len(values) != 1 || values[0] != binary.BigEndian.Uint64(key)+1 {
+			t.Error("No Pass")
+		}
+		return binary.BigEndian.Uint64(key)
+	}
+
+	if lookup(trie.Floor, 250) != 200 || lookup(trie.Floor, 200) != 200 || lookup(trie.Floor, 99) != 0 {
+		t.Error("No Pass")
+	}
+
+	if lookup(trie.Ceiling, 250) != 300 || lookup(trie.Ceiling, 300) != 300 || lookup(trie.Ceiling, 301) != 0x10000 {
+		t.Error("No Pass")
+	}
+
+	if lookup(trie.Prev, 200) != 100 || lookup(trie.Prev, 100) != 0 {
+		t.Error("No Pass")
+	}
+
+	if lookup(trie.Next, 300) != 0x10000 || lookup(trie.Next, 0x10000) != 0 {
+		t.Error("No Pass")
+	}
+
+	min, _ := trie.Min()
+	max, _ := trie.Max()
+	if binary.BigEndian.Uint64(min) != 100 || binary.BigEndian.Uint64(max) != 0x10000 {
+		t.Error("No Pass")
+	}
+
+	if key, _ := NewTrie().Min(); key != nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_RangeCount(t *testing.T) {
+	testRangeCount(t, NewTrie())
+	testRangeCount(t, NewTrieWithAggregates())
+
+	// 不维护聚合信息时写入不修改结点的计数
+	trie := NewTrie()
+	trie.Put([]byte{1, 2}, 1, 1)
+	trie.Put([]byte{1, 3}, 1, 2)
+	if trie.root.keyCount != 0 || trie.root.next.nodeAt(0).valueCount != 0 {
+		t.Error("No Pass")
+	}
+	if keys, values := trie.PrefixCount([]byte{1}); keys != 2 || values != 2 {
+		t.Error("No Pass", keys, values)
+	}
+}
+
+func testRangeCount(t *testing.T, trie *PTrie) {
+
+	var keys []uint64
+	for i := uint64(0); i < 20000; i++ {
+		k := uint64(rand.Uint32() % 50000)
+		keys = append(keys, k)
+
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, k)
+		trie.Put(buf, 1, i+1)
+	}
+
+	// 删除一半的value
+	for i := 0; i < len(keys); i += 2 {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, keys[i])
+		if !trie.Delete(buf, uint64(i+1)) {
+			t.Error("No Pass")
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, keys[0])
+	if trie.Delete(buf, 1) {
+		t.Error("No Pass")
+	}
+
+	check := func(lo, hi uint64) {
+		start := make([]byte, 8)
+		end := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, lo)
+		binary.BigEndian.PutUint64(end, hi)
+
+		var keyNum, valueNum int
+		trie.RangeScan(start, end, nil, func(key []byte, vals *vpack.VPack) bool {
+			keyNum++
+			valueNum += vals.Count()
+			return true
+		})
+
+		k, _ := trie.KeyCount(start, end)
+		v, _ := trie.RangeCount(start, end)
+		if k != keyNum || v != valueNum {
+			t.Error("No Pass", lo, hi, k, keyNum, v, valueNum)
+		}
+	}
+
+	check(0, 0xffffffff)
+	check(1000, 2000)
+	check(12345, 40000)
+	check(70000, 80000)
+
+	if v, _ := trie.RangeCount(nil, nil); v != len(keys)/2 {
+		t.Error("No Pass")
+	}
+
+	// 全部删除后树为空
+	for i := 1; i < len(keys); i += 2 {
+		binary.BigEndian.PutUint64(buf, keys[i])
+		trie.Delete(buf, uint64(i+1))
+	}
+
+	if key, _ := trie.Min(); key != nil || trie.root.next.Len() != 0 {
+		t.Error("No Pass")
+	}
+}
+
+var benchKeys = flag.Int("trie.keys", 1000000, "key number of the trie benchmarks")
+
+func benchTrie() (*PTrie, [][]byte, float64) {
+	rand.Seed(1)
+
+	keys := make([][]byte, *benchKeys)
+	for i := range keys {
+		keys[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(keys[i], rand.Uint32())
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	trie := NewTrie()
+	for i, key := range keys {
+		trie.Put(key, 1, uint64(i))
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	heap := float64(after.HeapAlloc-before.HeapAlloc) / float64(len(keys))
+
+	return trie, keys, heap
+}
+
+func BenchmarkPTrie_Put(b *testing.B) {
+	trie, keys, heap := benchTrie()
+
+	news := make([][]byte, b.N)
+	for i := range news {
+		news[i] = make([]byte, 4)
+		binary.BigEndian.PutUint32(news[i], rand.Uint32())
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Put(news[i], 1, uint64(len(keys)+i))
+	}
+	b.ReportMetric(heap, "heap-B/key")
+}
+
+func BenchmarkPTrie_Get(b *testing.B) {
+	trie, keys, heap := benchTrie()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Get(keys[i%len(keys)])
+	}
+	b.ReportMetric(heap, "heap-B/key")
+}
+
+func TestPTrieChunk_Adaptive(t *testing.T) {
+	trie := NewTrie()
+
+	perm := rand.Perm(256)
+	for _, b := range perm {
+		trie.Put([]byte{byte(b), 1}, 1, uint64(b))
+	}
+
+	if trie.root.next.kind() != node256 || trie.root.next.Len() != 256 {
+		t.Error("No Pass")
+	}
+
+	// 逐步删除, 依次降级为 node48/node16/node4
+	kinds := map[int]bool{}
+	for i, b := range perm {
+		key := []byte{byte(b), 1}
+		if !trie.Delete(key, uint64(b)) || trie.Get(key) != nil {
+			t.Error("No Pass")
+		}
+		kinds[trie.root.next.kind()] = true
+
+		// 排名与按排名取结点一致
+		chunk := trie.root.next
+		for r := 0; r < chunk.Len(); r++ {
+			node := chunk.nodeAt(r)
+			if node == nil || chunk.location(node.key) != r {
+				t.Error("No Pass", r)
+			}
+		}
+		if chunk.location(key) >= 0 {
+			t.Error("No Pass")
+		}
+
+		// 剩余的key保持有序
+		var last = -1
+		var count int
+		trie.RangeScan(nil, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+			if int(key[0]) <= last {
+				t.Error("No Pass")
+			}
+			last = int(key[0])
+			count++
+			return true
+		})
+		if count != 255-i {
+			t.Error("No Pass")
+		}
+	}
+
+	if !kinds[node48] || !kinds[node16] || !kinds[node4] {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_Freeze(t *testing.T) {
+	trie := NewTrie()
+
+	var keys [][]byte
+	for i := uint64(0); i < 10000; i++ {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(rand.Uint32()%100000))
+		keys = append(keys, buf)
+		trie.Put(buf, 1, i+1)
+	}
+
+	frozen, err := trie.Freeze()
+	if err != nil {
+		t.Fatal("No Pass", err)
+	}
+
+	var data bytes.Buffer
+	if _, err := frozen.WriteTo(&data); err != nil {
+		t.Error("No Pass")
+	}
+
+	loaded, err := LoadFrozenTrie(data.Bytes())
+	if err != nil {
+		t.Error("No Pass")
+		return
+	}
+
+	equal := func(a, b []uint64) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, ft := range []*FrozenTrie{frozen, loaded} {
+		for _, key := range keys[:100] {
+			if !equal(trie.Get(key), ft.Get(key)) {
+				t.Error("No Pass")
+			}
+		}
+
+		r1, _ := trie.RangeQuery(keys[0], keys[1])
+		r2, _ := ft.RangeQuery(keys[0], keys[1])
+		if compare(keys[0], keys[1]) <= 0 && !equal(r1, r2) {
+			t.Error("No Pass")
+		}
+
+		prefix := []byte{0, 0, 0, 0, 0, 1}
+		if !equal(trie.PrefixQuery(prefix), ft.PrefixQuery(prefix)) || len(ft.PrefixQuery(prefix)) == 0 {
+			t.Error("No Pass")
+		}
+
+		var count int
+		ft.RangeScan(nil, nil, &ScanOptions{Reverse: true}, func(key []byte, vals *vpack.VPack) bool {
+			count += vals.Count()
+			return true
+		})
+		if count != len(keys) {
+			t.Error("No Pass")
+		}
+	}
+}
+
+func TestLoadFrozenTrie_Corrupt(t *testing.T) {
+	trie := NewTrie()
+	for i := uint64(0); i < 1000; i++ {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, rand.Uint32()%5000)
+		trie.Put(buf, 1, i+1)
+	}
+
+	frozen, err := trie.Freeze()
+	if err != nil {
+		t.Fatal("No Pass", err)
+	}
+
+	var buf bytes.Buffer
+	frozen.WriteTo(&buf)
+	data := buf.Bytes()
+
+	// 截断的数据和超大的valueNum返回错误
+	if _, err := LoadFrozenTrie(data[:len(data)-1]); err == nil {
+		t.Error("No Pass")
+	}
+	huge := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(huge[16:], 1<<61)
+	if _, err := LoadFrozenTrie(huge); err == nil {
+		t.Error("No Pass")
+	}
+
+	// 结点中的任意字段被改写后, 加载返回错误或者查询不会panic
+	nodeNum := int(binary.LittleEndian.Uint32(data[8:]))
+	for i := 0; i < 2000; i++ {
+		corrupt := append([]byte(nil), data...)
+		off := frozenHeaderSize + rand.Intn(nodeNum*frozenNodeSize)
+		binary.LittleEndian.PutUint32(corrupt[off&^3:], rand.Uint32()>>uint(rand.Intn(32)))
+
+		ft, err := LoadFrozenTrie(corrupt)
+		if err != nil {
+			continue
+		}
+
+		ft.Get([]byte{0, 0, 1, 2})
+		ft.RangeQuery(nil, nil)
+	}
+}
+
+func TestPTrie_FilterScan(t *testing.T) {
+	trie := NewTrieWithAggregates()
+
+	for i := uint64(0); i < 4096; i++ {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(i*16))
+		trie.Put(buf, 1, i)
+	}
+
+	key := func(v uint32) []byte {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, v)
+		return buf
+	}
+
+	cases := []struct {
+		pred  Predicate
+		count int
+	}{
+		{&EqPredicate{Key: key(160)}, 1},
+		{&InPredicate{Keys: [][]byte{key(16), key(17), key(32)}}, 2},
+		{&RangePredicate{Start: key(100), End: key(1600)}, 94},
+		{&RangePredicate{Start: key(1600)}, 4096 - 100},
+		{&PrefixPredicate{Prefix: []byte{0, 0, 1}}, 16},
+		{&CIDRPredicate{IP: key(0x400), Bits: 20}, 256},
+	}
+
+	for i, c := range cases {
+		var (
+			count int
+			prev  []byte
+			stats ScanStats
+		)
+		trie.FilterScan(c.pred, &ScanOptions{Reverse: true, Stats: &stats}, func(k []byte, vals *vpack.VPack) bool {
+			if !c.pred.Match(k) || (prev != nil && compare(k, prev) >= 0) {
+				t.Error("No Pass", i)
+			}
+			prev = append(prev[:0], k...)
+			count += vals.Count()
+			return true
+		})
+
+		if count != c.count || stats.Keys != c.count || stats.Nodes < stats.Keys || stats.Chunks == 0 {
+			t.Error("No Pass", i, count, stats)
+		}
+
+		if _, values := trie.FilterCount(c.pred); values != c.count {
+			t.Error("No Pass", i, values)
+		}
+
+		if p, ok := c.pred.(*PrefixPredicate); ok {
+			if keys, values := trie.PrefixCount(p.Prefix); keys != c.count || values != c.count {
+				t.Error("No Pass", i, keys, values)
+			}
+		}
+	}
+
+	var stats ScanStats
+	if pack := trie.LookupStats(key(160), &stats); pack == nil || pack.Count() != 1 || stats.Keys != 1 || stats.Nodes == 0 {
+		t.Error("No Pass", stats)
+	}
+	if trie.Lookup(key(161)) != nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_PutPrefix(t *testing.T) {
+	// 先插入长key再插入其前缀, 前缀在结点key的中间结束; 以及在没有子chunk的叶子下插入更长的key
+	cases := [][][]byte{
+		{{10, 1, 0, 0}, {10}, {10, 1}},
+		{{10}, {10, 1}, {10, 1, 0, 0}},
+		{{11, 2, 3, 4}, {11, 2}, {11, 2, 3, 4, 5}, {11, 2, 3}},
+	}
+
+	for _, keys := range cases {
+		trie := NewTrie()
+		for i, key := range keys {
+			if err := trie.Put(key, 1, uint64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, key := range keys {
+			if ret := trie.Get(key); len(ret) != 1 || ret[0] != uint64(i) {
+				t.Error("No Pass", keys, i, ret)
+			}
+		}
+
+		if n, _ := trie.KeyCount(nil, nil); n != len(keys) {
+			t.Error("No Pass", keys, n)
+		}
+
+		var scanned [][]byte
+		trie.RangeScan(nil, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+			scanned = append(scanned, append([]byte{}, key...))
+			return true
+		})
+		if len(scanned) != len(keys) {
+			t.Error("No Pass", keys, scanned)
+		}
+		for i := 1; i < len(scanned); i++ {
+			if bytes.Compare(scanned[i-1], scanned[i]) >= 0 {
+				t.Error("No Pass", scanned)
+			}
+		}
+
+		// 删除前缀不影响更长的key
+		if !trie.Delete(keys[1], 1) || trie.Get(keys[1]) != nil || len(trie.Get(keys[0])) != 1 {
+			t.Error("No Pass", keys)
+		}
+	}
+}
+
+func TestPTrie_PrefixesOf(t *testing.T) {
+	trie := NewTrie()
+
+	// 长短不一的key, 先插入长key再插入其前缀, 以及反过来
+	keys := [][]byte{
+		{10, 1, 0, 0},
+		{10},
+		{10, 1},
+		{11, 2, 3, 4},
+		{11},
+		{11, 2, 3, 4, 5},
+	}
+	for i, key := range keys {
+		if err := trie.Put(key, 1, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, key := range keys {
+		if ret := trie.Get(key); len(ret) != 1 || ret[0] != uint64(i) {
+			t.Error("No Pass", i, ret)
+		}
+	}
+
+	if n, _ := trie.KeyCount(nil, nil); n != len(keys) {
+		t.Error("No Pass", n)
+	}
+
+	var prev []byte
+	trie.RangeScan(nil, nil, nil, func(key []byte, vals *vpack.VPack) bool {
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Error("No Pass", prev, key)
+		}
+		prev = append(prev[:0], key...)
+		return true
+	})
+
+	var values []uint64
+	trie.PrefixesOf([]byte{10, 1, 0, 0}, nil, func(key []byte, vals *vpack.VPack) bool {
+		values = append(values, vals.Unpack()...)
+		return true
+	})
+	if len(values) != 3 || values[0] != 1 || values[1] != 2 || values[2] != 0 {
+		t.Error("No Pass", values)
+	}
+
+	if key, ret := trie.LongestPrefix([]byte{11, 2, 3, 9}); !bytes.Equal(key, []byte{11}) || ret[0] != 4 {
+		t.Error("No Pass", key, ret)
+	}
+	if key, _ := trie.LongestPrefix([]byte{12}); key != nil {
+		t.Error("No Pass", key)
+	}
+
+	if !trie.Delete([]byte{11}, 4) || trie.Get([]byte{11, 2, 3, 4, 5})[0] != 5 {
+		t.Error("No Pass")
+	}
+	if ft, err := trie.Freeze(); err != nil || ft.Get([]byte{10, 1})[0] != 2 || ft.Get([]byte{11}) != nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_Regexp(t *testing.T) {
+	trie := NewTrie()
+
+	keys := []string{
+		"api-1.prod.example", "api-12.prod.example", "api-x.prod.example", "api-3.dev.example",
+		"web-01.prod", "web-02.dev", "db", "db-01", "API-7.prod.", "ápi-1.prod.", "api-",
+	}
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, fmt.Sprintf("host-%d.dc%d", i, i%7))
+	}
+	for i, key := range keys {
+		trie.Put([]byte(key), 0, uint64(i))
+	}
+
+	exprs := []string{
+		`^api-[0-9]+\.prod\.`, `prod`, `^db$`, `^db`, `\.dev\.example$`, `(?i)^api-\d`, `^.pi-1`,
+		`^host-1[0-9]\.dc[0-3]$`, `^web-0[12]\.(prod|dev)$`, `\bprod\b`, `^$`, `x*`, `^api-$`,
+	}
+	for _, expr := range exprs {
+		pred, err := NewRegexpPredicate(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile(expr)
+
+		expect := vpack.NewValuePack(0, 0)
+		for i, key := range keys {
+			if re.MatchString(key) != pred.Match([]byte(key)) {
+				t.Error("No Pass", expr, key)
+			}
+			if re.MatchString(key) {
+				expect.Add(uint64(i))
+			}
+		}
+
+		stats := &ScanStats{}
+		ret := trie.FilterQuery(pred, stats)
+		if fmt.Sprint(ret.Unpack()) != fmt.Sprint(expect.Unpack()) {
+			t.Error("No Pass", expr, ret.Unpack(), expect.Unpack())
+		}
+
+		if _, values := trie.FilterCount(pred); values != expect.Count() {
+			t.Error("No Pass", expr, values)
+		}
+
+		// 锚定的正则只访问少量结点
+		if expr == `^api-[0-9]+\.prod\.` && stats.Nodes > 20 {
+			t.Error("No Pass", expr, stats)
+		}
+	}
+
+	if _, err := NewRegexpPredicate(`(`); err == nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_FuzzySearch(t *testing.T) {
+	trie := NewTrie()
+
+	keys := []string{"web-01", "web-02", "web-1", "web", "wbe-01", "db-01", "api-01.prod", "we", "web-010"}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("host-%d", i))
+	}
+	for i, key := range keys {
+		trie.Put([]byte(key), 0, uint64(i))
+	}
+
+	distance := func(a, b string) int {
+		row := make([]int, len(b)+1)
+		for j := range row {
+			row[j] = j
+		}
+		for i := 1; i <= len(a); i++ {
+			prev := row[0]
+			row[0] = i
+			for j := 1; j <= len(b); j++ {
+				cur := row[j]
+				cost := 1
+				if a[i-1] == b[j-1] {
+					cost = 0
+				}
+				row[j] = prev + cost
+				if row[j-1]+1 < row[j] {
+					row[j] = row[j-1] + 1
+				}
+				if cur+1 < row[j] {
+					row[j] = cur + 1
+				}
+				prev = cur
+			}
+		}
+		return row[len(b)]
+	}
+
+	for _, query := range []string{"web-01", "wb-01", "host-10", "", "xyz"} {
+		for edits := 0; edits <= 2; edits++ {
+			var expect []string
+			for _, key := range keys {
+				if distance(query, key) <= edits {
+					expect = append(expect, key)
+				}
+			}
+
+			matches := trie.FuzzySearch([]byte(query), edits, 0)
+			if len(matches) != len(expect) {
+				t.Error("No Pass", query, edits, len(matches), len(expect))
+				continue
+			}
+			for i, m := range matches {
+				if m.Distance != distance(query, string(m.Key)) || m.Values.Count() != 1 {
+					t.Error("No Pass", query, string(m.Key), m.Distance)
+				}
+				if i > 0 && m.Distance < matches[i-1].Distance {
+					t.Error("No Pass", query, "unsorted")
+				}
+			}
+		}
+	}
+
+	matches := trie.FuzzySearch([]byte("web-01"), 1, 3)
+	if len(matches) != 3 || string(matches[0].Key) != "web-01" || matches[0].Distance != 0 ||
+		string(matches[1].Key) != "web-010" || string(matches[2].Key) != "web-02" {
+		t.Error("No Pass", matches)
+	}
+	if trie.FuzzySearch([]byte("web"), -1, 0) != nil {
+		t.Error("No Pass")
+	}
+
+	// 带limit时提前剪枝, 结果与不限数量时的前limit个相同
+	for _, query := range []string{"web-01", "host-10", "host-999", "xyz"} {
+		all := trie.FuzzySearch([]byte(query), 3, 0)
+		for _, limit := range []int{1, 2, 5, 20} {
+			matches := trie.FuzzySearch([]byte(query), 3, limit)
+			expect := all
+			if len(expect) > limit {
+				expect = expect[:limit]
+			}
+
+			if len(matches) != len(expect) {
+				t.Error("No Pass", query, limit, len(matches))
+				continue
+			}
+			for i := range matches {
+				if !bytes.Equal(matches[i].Key, expect[i].Key) || matches[i].Distance != expect[i].Distance {
+					t.Error("No Pass", query, limit, string(matches[i].Key))
+				}
+			}
+		}
+	}
+}
+
+func TestPTrie_TernaryMatch(t *testing.T) {
+	trie := NewTrie()
+
+	type rule struct {
+		value, mask uint16
+	}
+	rules := []rule{
+		{0x0050, 0xfff0}, {0x0050, 0xffff}, {0x1234, 0xff00}, {0x0000, 0x0000},
+		{0x0001, 0x0001}, {0x00f0, 0x00f0}, {0x8000, 0x8000}, {0x0050, 0xfff0},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		rules = append(rules, rule{uint16(r.Intn(1 << 16)), uint16(r.Intn(1 << 16))})
+	}
+
+	encode := func(v uint16) []byte {
+		return []byte{byte(v >> 8), byte(v)}
+	}
+	for i, rl := range rules {
+		key := TernaryKey(encode(rl.value), encode(rl.mask))
+		trie.Put(key, 0, uint64(i))
+
+		value, mask := ParseTernaryKey(key, 2)
+		if !bytes.Equal(mask, encode(rl.mask)) || !bytes.Equal(value, encode(rl.value&rl.mask)) {
+			t.Error("No Pass", rl, value, mask)
+		}
+	}
+
+	if len(TernaryKey(encode(0x1234), encode(0xff00))) != 2 || len(TernaryKey(encode(0), encode(0))) != 2 {
+		t.Error("No Pass")
+	}
+
+	for _, v := range []uint16{0x0050, 0x0055, 0x12ff, 0x0001, 0x80f1, 0xffff, 0} {
+		expect := vpack.NewValuePack(0, 0)
+		for i, rl := range rules {
+			if v&rl.mask == rl.value&rl.mask {
+				expect.Add(uint64(i))
+			}
+		}
+
+		ret := vpack.NewValuePack(0, 0)
+		stats := &ScanStats{}
+		trie.TernaryMatch(encode(v), stats, func(key []byte, vals *vpack.VPack) bool {
+			ret.Merge(vals)
+			return true
+		})
+		if fmt.Sprint(ret.Unpack()) != fmt.Sprint(expect.Unpack()) {
+			t.Error("No Pass", v, ret.Unpack(), expect.Unpack())
+		}
+	}
+
+	if trie.TernaryMatch(encode(0), nil, nil) == nil {
+		t.Error("No Pass")
+	}
+}
+
+func TestPTrie_Context(t *testing.T) {
+	trie := NewTrie()
+	for i := uint64(0); i < 10000; i++ {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(i*7919))
+		trie.Put(buf, 0, i)
+	}
+
+	all, err := trie.RangeQueryContext(context.Background(), nil, []byte{0xff, 0xff, 0xff, 0xff})
+	if err != nil || len(all) != 10000 {
+		t.Error("No Pass", len(all), err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := trie.RangeQueryContext(canceled, []byte{0}, []byte{0xff}); err != context.Canceled {
+		t.Error("No Pass", err)
+	}
+	if _, err := trie.FilterQueryContext(canceled, &PrefixPredicate{Prefix: []byte{0}}, nil); err != context.Canceled {
+		t.Error("No Pass", err)
+	}
+
+	// 扫描过程中超时, 返回部分结果
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	n := 0
+	err = trie.RangeScan(nil, nil, &ScanOptions{Context: ctx}, func(key []byte, vals *vpack.VPack) bool {
+		if n++; n == 1000 {
+			cancel()
+		}
+		return true
+	})
+	if err != context.Canceled || n < 1000 || n >= 10000 {
+		t.Error("No Pass", n, err)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	ret, err := trie.FilterQueryContext(expired, &RangePredicate{}, nil)
+	if err != context.DeadlineExceeded || ret.Count() != 0 {
+		t.Error("No Pass", err)
+	}
+}
@@ -0,0 +1,227 @@
+package trie
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sync"
+	"unicode/utf8"
+)
+
+// RegexpPredicate key满足正则表达式, 语法与regexp相同, 没有锚定时在key的任意位置匹配即可
+// 正则被编译为NFA, 沿trie逐字节推进, 没有存活状态的前缀整棵子树被剪掉;
+// 已经到达匹配且不依赖后续字符时整棵子树都满足
+type RegexpPredicate struct {
+	Expr string
+
+	prog *syntax.Prog
+	// anchored 只能从key的开头匹配, 否则每个位置都要加入起始状态
+	anchored bool
+
+	// 遍历是深度优先的, 缓存上一次访问的路径上每个字节之后的状态, 下一次只需要从公共前缀继续推进
+	mu     sync.Mutex
+	path   []byte
+	states []*regexpState
+}
+
+// regexpState 推进若干字节之后的NFA状态
+type regexpState struct {
+	// pcs 存活的线程, 尚未展开空宽度指令, 展开需要知道下一个字符
+	pcs []uint32
+	// prev 最后一个完整的字符, 开头为-1
+	prev rune
+	// pending 尚未组成完整UTF-8字符的字节
+	pending []byte
+	// matched 已经在之前的位置到达匹配, 之后的字节不影响结果
+	matched bool
+}
+
+// NewRegexpPredicate 编译正则表达式
+func NewRegexpPredicate(expr string) (*RegexpPredicate, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+
+	p := &RegexpPredicate{
+		Expr:     expr,
+		prog:     prog,
+		anchored: prog.StartCond()&syntax.EmptyBeginText != 0,
+	}
+	p.states = []*regexpState{{pcs: []uint32{uint32(prog.Start)}, prev: -1}}
+
+	return p, nil
+}
+
+// Regexp key满足正则表达式expr
+func Regexp(attr string, expr string) (Filter, error) {
+	pred, err := NewRegexpPredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AttrFilter{Attr: attr, Pred: pred}, nil
+}
+
+func (p *RegexpPredicate) Match(key []byte) bool {
+	st := p.advance(key)
+
+	// 末尾不完整的字节按regexp的规则逐个当作 utf8.RuneError
+	pcs, prev, matched := st.pcs, st.prev, st.matched
+	for range st.pending {
+		if matched {
+			return true
+		}
+		pcs, matched = p.step(pcs, prev, utf8.RuneError)
+		prev = utf8.RuneError
+	}
+
+	return matched || p.matched(pcs, syntax.EmptyOpContext(prev, -1))
+}
+
+func (p *RegexpPredicate) Test(prefix []byte) Cover {
+	st := p.advance(prefix)
+	if st.matched {
+		return CoverAll
+	}
+
+	if len(st.pcs) == 0 {
+		return CoverNone
+	}
+
+	// 只使用不依赖下一个字符的断言, 能到达匹配说明任意后缀都满足
+	ctx := syntax.EmptyOpContext(st.prev, -1) & (syntax.EmptyBeginText | syntax.EmptyBeginLine)
+	if len(st.pending) == 0 && p.matched(st.pcs, ctx) {
+		return CoverAll
+	}
+
+	return CoverPart
+}
+
+func (p *RegexpPredicate) String() string {
+	return fmt.Sprintf("~ %q", p.Expr)
+}
+
+// advance 返回推进key之后的状态, 复用与上一次路径的公共前缀
+func (p *RegexpPredicate) advance(key []byte) *regexpState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for n < len(p.path) && n < len(key) && p.path[n] == key[n] {
+		n++
+	}
+	p.path = append(p.path[:n], key[n:]...)
+	p.states = p.states[:n+1]
+
+	for _, b := range key[n:] {
+		p.states = append(p.states, p.next(p.states[len(p.states)-1], b))
+	}
+
+	return p.states[len(key)]
+}
+
+// next 推进一个字节, 凑成完整的字符后才推进NFA
+func (p *RegexpPredicate) next(st *regexpState, b byte) *regexpState {
+	pending := make([]byte, 0, len(st.pending)+1)
+	pending = append(append(pending, st.pending...), b)
+
+	ret := &regexpState{pcs: st.pcs, prev: st.prev, matched: st.matched}
+	for !ret.matched && len(pending) > 0 && utf8.FullRune(pending) {
+		r, size := utf8.DecodeRune(pending)
+		ret.pcs, ret.matched = p.step(ret.pcs, ret.prev, r)
+		ret.prev = r
+		pending = pending[size:]
+	}
+
+	if ret.matched {
+		return &regexpState{matched: true}
+	}
+
+	if len(pending) > 0 {
+		ret.pending = pending
+	}
+	return ret
+}
+
+// step 在prev和r之间展开空宽度指令, 然后消费r; 展开时到达匹配返回true
+func (p *RegexpPredicate) step(pcs []uint32, prev rune, r rune) ([]uint32, bool) {
+	var next []uint32
+	seen := make(map[uint32]bool)
+	for _, pc := range p.closure(pcs, syntax.EmptyOpContext(prev, r)) {
+		inst := &p.prog.Inst[pc]
+
+		var ok bool
+		switch inst.Op {
+		case syntax.InstMatch:
+			return nil, true
+		case syntax.InstRune, syntax.InstRune1:
+			ok = inst.MatchRune(r)
+		case syntax.InstRuneAny:
+			ok = true
+		case syntax.InstRuneAnyNotNL:
+			ok = r != '\n'
+		}
+
+		if ok && !seen[inst.Out] {
+			seen[inst.Out] = true
+			next = append(next, inst.Out)
+		}
+	}
+
+	if !p.anchored && !seen[uint32(p.prog.Start)] {
+		next = append(next, uint32(p.prog.Start))
+	}
+
+	return next, false
+}
+
+// closure 沿Alt、Nop、Capture以及ctx满足的空宽度指令展开, 返回消费字符或匹配的指令
+func (p *RegexpPredicate) closure(pcs []uint32, ctx syntax.EmptyOp) []uint32 {
+	var ret []uint32
+	seen := make(map[uint32]bool)
+
+	var visit func(pc uint32)
+	visit = func(pc uint32) {
+		if seen[pc] {
+			return
+		}
+		seen[pc] = true
+
+		inst := &p.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			visit(inst.Out)
+			visit(inst.Arg)
+		case syntax.InstNop, syntax.InstCapture:
+			visit(inst.Out)
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^ctx == 0 {
+				visit(inst.Out)
+			}
+		case syntax.InstFail:
+		default:
+			ret = append(ret, pc)
+		}
+	}
+
+	for _, pc := range pcs {
+		visit(pc)
+	}
+
+	return ret
+}
+
+func (p *RegexpPredicate) matched(pcs []uint32, ctx syntax.EmptyOp) bool {
+	for _, pc := range p.closure(pcs, ctx) {
+		if p.prog.Inst[pc].Op == syntax.InstMatch {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,356 @@
+package trie
+
+import (
+	"context"
+	"errors"
+
+	"github.com/anbien/polyer/pkg/vpack"
+)
+
+// ScanOptions 范围扫描的选项, 零值表示闭区间、不限数量、升序
+type ScanOptions struct {
+	// ExcludeStart 不包含起始key
+	ExcludeStart bool
+	// ExcludeEnd 不包含结束key
+	ExcludeEnd bool
+	// Limit 最多访问的key数量, <= 0 表示不限制
+	Limit int
+	// Reverse 按key降序访问
+	Reverse bool
+	// Stats 不为nil时记录扫描过程中访问的chunk、结点和key的数量
+	Stats *ScanStats
+	// Context 不为nil时在遍历过程中定期检查, 被取消或超时后终止扫描并返回 Context.Err()
+	Context context.Context
+}
+
+// contextCheckInterval 每访问多少个结点检查一次Context
+const contextCheckInterval = 256
+
+// ScanStats 扫描过程的统计, 多次扫描可以累加到同一个ScanStats
+type ScanStats struct {
+	Chunks int
+	Nodes  int
+	Keys   int
+}
+
+// ScanFunc 扫描回调, 返回false则立即终止扫描
+// key 只在回调期间有效, 需要保留时请自行拷贝; vals 为结点内部的VPack, 不允许修改
+type ScanFunc func(key []byte, vals *vpack.VPack) bool
+
+type scanner struct {
+	start []byte
+	end   []byte
+	opts  ScanOptions
+	fn    ScanFunc
+
+	count int
+
+	// visited 访问过的结点数量, 用于定期检查Context; err 为Context终止扫描的原因
+	visited int
+	err     error
+}
+
+// canceled Context被取消或超时时记录原因并返回true
+func (s *scanner) canceled() bool {
+	if s.opts.Context == nil {
+		return false
+	}
+
+	if s.visited++; s.visited%contextCheckInterval != 0 {
+		return false
+	}
+
+	s.err = s.opts.Context.Err()
+	return s.err != nil
+}
+
+// contextErr 扫描开始前Context已经结束时返回原因
+func contextErr(opts *ScanOptions) error {
+	if opts == nil || opts.Context == nil {
+		return nil
+	}
+
+	return opts.Context.Err()
+}
+
+// RangeScan 按key顺序访问[start, end]范围内的key
+// start 为nil表示不限下界, end 为nil表示不限上界
+func (pt *PTrie) RangeScan(start, end []byte, opts *ScanOptions, fn ScanFunc) error {
+	if fn == nil {
+		return errors.New("scan func is nil")
+	}
+
+	if start != nil && end != nil && compare(start, end) > 0 {
+		return errors.New("不是合法的范围")
+	}
+
+	if err := contextErr(opts); err != nil {
+		return err
+	}
+
+	s := &scanner{
+		start: start,
+		end:   end,
+		fn:    fn,
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	s.scanChunk(pt.root.next, make([]byte, 0, 16))
+
+	return s.err
+}
+
+func (s *scanner) scanChunk(chunk *PTrieChunk, prefix []byte) bool {
+	if chunk == nil {
+		return true
+	}
+
+	if s.opts.Stats != nil {
+		s.opts.Stats.Chunks++
+	}
+
+	return chunk.each(s.opts.Reverse, func(node *PTrieNode) bool {
+		return s.scanNode(node, prefix)
+	})
+}
+
+func (s *scanner) scanNode(node *PTrieNode, prefix []byte) bool {
+	if s.canceled() {
+		return false
+	}
+
+	if s.opts.Stats != nil {
+		s.opts.Stats.Nodes++
+	}
+
+	// 深度优先遍历, 兄弟结点复用同一段缓冲区
+	key := append(prefix, node.key...)
+	if s.skip(key) {
+		return true
+	}
+
+	if !s.opts.Reverse && !s.visit(node, key) {
+		return false
+	}
+
+	if s.descend(key) && !s.scanChunk(node.next, key) {
+		return false
+	}
+
+	if s.opts.Reverse && !s.visit(node, key) {
+		return false
+	}
+
+	return true
+}
+
+// skip 子树中的key都以key为前缀且都大于key, 整棵子树都小于start时跳过
+func (s *scanner) skip(key []byte) bool {
+	return s.start != nil && compare(key, s.start) < 0 && !hasPrefix(s.start, key)
+}
+
+// descend 子树中的key都大于key, key已经不小于end时无需下降
+func (s *scanner) descend(key []byte) bool {
+	return s.end == nil || compare(key, s.end) < 0
+}
+
+func (s *scanner) visit(node *PTrieNode, key []byte) bool {
+	if node.vPack == nil || node.vPack.Size() == 0 || !s.inRange(key) {
+		return true
+	}
+
+	return s.emit(key, node.vPack)
+}
+
+func (s *scanner) emit(key []byte, vals *vpack.VPack) bool {
+	s.count++
+	if s.opts.Stats != nil {
+		s.opts.Stats.Keys++
+	}
+
+	if !s.fn(key, vals) {
+		return false
+	}
+
+	return s.opts.Limit <= 0 || s.count < s.opts.Limit
+}
+
+func (s *scanner) inRange(key []byte) bool {
+	if s.start != nil {
+		ret := compare(key, s.start)
+		if ret < 0 || (ret == 0 && s.opts.ExcludeStart) {
+			return false
+		}
+	}
+
+	if s.end != nil {
+		ret := compare(key, s.end)
+		if ret > 0 || (ret == 0 && s.opts.ExcludeEnd) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasPrefix(key, prefix []byte) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+
+	return compare(key[:len(prefix)], prefix) == 0
+}
+
+// PrefixScan 按key顺序访问以prefix为前缀的key
+// 先沿prefix下降到子树的根, 只遍历这棵子树
+func (pt *PTrie) PrefixScan(prefix []byte, fn ScanFunc) error {
+	if fn == nil {
+		return errors.New("scan func is nil")
+	}
+
+	s := &scanner{fn: fn}
+	if len(prefix) == 0 {
+		s.scanChunk(pt.root.next, make([]byte, 0, 16))
+		return nil
+	}
+
+	key := make([]byte, 0, len(prefix)+8)
+	chunk := pt.root.next
+	remainKey := prefix
+	for chunk != nil {
+		node := chunk.find(remainKey[0])
+		if node == nil {
+			return nil
+		}
+
+		// prefix在结点内结束, 整棵子树都以prefix为前缀
+		if len(remainKey) <= len(node.key) {
+			if hasPrefix(node.key, remainKey) {
+				s.scanNode(node, key)
+			}
+			return nil
+		}
+
+		if !hasPrefix(remainKey, node.key) {
+			return nil
+		}
+
+		key = append(key, node.key...)
+		remainKey = remainKey[len(node.key):]
+		chunk = node.next
+	}
+
+	return nil
+}
+
+// PrefixQuery 查找以prefix为前缀的所有key的value
+func (pt *PTrie) PrefixQuery(prefix []byte) []uint64 {
+	newPack := &vpack.VPack{}
+	pt.PrefixScan(prefix, func(key []byte, vals *vpack.VPack) bool {
+		newPack.Merge(vals)
+		return true
+	})
+
+	return newPack.Unpack()
+}
+
+// first 按给定范围和方向找到第一个存储的key
+func (pt *PTrie) first(start, end []byte, opts *ScanOptions) ([]byte, []uint64) {
+	var (
+		key    []byte
+		values []uint64
+	)
+
+	opts.Limit = 1
+	pt.RangeScan(start, end, opts, func(k []byte, vals *vpack.VPack) bool {
+		key = append([]byte{}, k...)
+		values = vals.Unpack()
+		return false
+	})
+
+	return key, values
+}
+
+// Floor 查找小于等于key的最大key, 不存在时返回nil
+func (pt *PTrie) Floor(key []byte) ([]byte, []uint64) {
+	return pt.first(nil, key, &ScanOptions{Reverse: true})
+}
+
+// Ceiling 查找大于等于key的最小key, 不存在时返回nil
+func (pt *PTrie) Ceiling(key []byte) ([]byte, []uint64) {
+	return pt.first(key, nil, &ScanOptions{})
+}
+
+// Prev 查找严格小于key的最大key, 不存在时返回nil
+func (pt *PTrie) Prev(key []byte) ([]byte, []uint64) {
+	return pt.first(nil, key, &ScanOptions{ExcludeEnd: true, Reverse: true})
+}
+
+// Next 查找严格大于key的最小key, 不存在时返回nil
+func (pt *PTrie) Next(key []byte) ([]byte, []uint64) {
+	return pt.first(key, nil, &ScanOptions{ExcludeStart: true})
+}
+
+// Min 返回最小的key, 空树时返回nil
+func (pt *PTrie) Min() ([]byte, []uint64) {
+	return pt.first(nil, nil, &ScanOptions{})
+}
+
+// Max 返回最大的key, 空树时返回nil
+func (pt *PTrie) Max() ([]byte, []uint64) {
+	return pt.first(nil, nil, &ScanOptions{Reverse: true})
+}
+
+// PrefixesOf 按长度递增访问key的所有前缀(包含key自身)中存储的key, stats 不为nil时记录访问情况
+func (pt *PTrie) PrefixesOf(key []byte, stats *ScanStats, fn ScanFunc) {
+	chunk := pt.root.next
+	remainKey := key
+	for chunk != nil && len(remainKey) > 0 {
+		if stats != nil {
+			stats.Chunks++
+		}
+
+		node := chunk.find(remainKey[0])
+		if node == nil || !hasPrefix(remainKey, node.key) {
+			return
+		}
+
+		if stats != nil {
+			stats.Nodes++
+		}
+
+		remainKey = remainKey[len(node.key):]
+		if node.vPack != nil && node.vPack.Size() > 0 {
+			if stats != nil {
+				stats.Keys++
+			}
+
+			if !fn(key[:len(key)-len(remainKey)], node.vPack) {
+				return
+			}
+		}
+
+		chunk = node.next
+	}
+}
+
+// LongestPrefix 查找key的最长前缀(包含key自身), 不存在时返回nil
+func (pt *PTrie) LongestPrefix(key []byte) ([]byte, []uint64) {
+	var (
+		prefix []byte
+		pack   *vpack.VPack
+	)
+
+	pt.PrefixesOf(key, nil, func(k []byte, vals *vpack.VPack) bool {
+		prefix, pack = k, vals
+		return true
+	})
+
+	if pack == nil {
+		return nil, nil
+	}
+
+	return append([]byte{}, prefix...), pack.Unpack()
+}
@@ -0,0 +1,98 @@
+package trie
+
+import "errors"
+
+// 三态key: value/mask 的每个字节编码为 mask 和 value&mask 两个字节, 末尾mask为0的字节被去掉, 至少保留一个字节;
+// 查找时在mask字节上遍历所有分支, 在value字节上只下降到 key&mask 一个分支, 不需要展开通配位
+
+// TernaryKey 将value/mask编码为三态key, value和mask的长度必须相同
+func TernaryKey(value, mask []byte) []byte {
+	n := len(mask)
+	for n > 1 && mask[n-1] == 0 {
+		n--
+	}
+
+	key := make([]byte, 0, 2*n)
+	for i := 0; i < n; i++ {
+		key = append(key, mask[i], value[i]&mask[i])
+	}
+
+	return key
+}
+
+// ParseTernaryKey 将三态key解码为n个字节的value和mask
+func ParseTernaryKey(key []byte, n int) ([]byte, []byte) {
+	value, mask := make([]byte, n), make([]byte, n)
+	for i := 0; i+1 < len(key) && i/2 < n; i += 2 {
+		mask[i/2], value[i/2] = key[i], key[i+1]
+	}
+
+	return value, mask
+}
+
+// TernaryMatch 访问满足 key&mask == value&mask 的三态key, stats 不为nil时记录访问情况
+func (pt *PTrie) TernaryMatch(key []byte, stats *ScanStats, fn ScanFunc) error {
+	if fn == nil {
+		return errors.New("scan func is nil")
+	}
+
+	s := &scanner{fn: fn, opts: ScanOptions{Stats: stats}}
+	s.ternaryChunk(pt.root.next, key, 0, 0, make([]byte, 0, 2*len(key)))
+
+	return nil
+}
+
+// ternaryChunk pos 为已经匹配的三态key长度, mask 为当前字节的mask
+func (s *scanner) ternaryChunk(chunk *PTrieChunk, key []byte, pos int, mask byte, prefix []byte) bool {
+	if chunk == nil {
+		return true
+	}
+
+	if s.opts.Stats != nil {
+		s.opts.Stats.Chunks++
+	}
+
+	if pos%2 == 1 {
+		// value字节只有 key&mask 一个分支
+		node := chunk.find(key[pos/2] & mask)
+		if node == nil {
+			return true
+		}
+		return s.ternaryNode(node, key, pos, mask, prefix)
+	}
+
+	return chunk.each(false, func(node *PTrieNode) bool {
+		return s.ternaryNode(node, key, pos, mask, prefix)
+	})
+}
+
+func (s *scanner) ternaryNode(node *PTrieNode, key []byte, pos int, mask byte, prefix []byte) bool {
+	if s.opts.Stats != nil {
+		s.opts.Stats.Nodes++
+	}
+
+	for _, b := range node.key {
+		if pos/2 >= len(key) {
+			return true
+		}
+
+		if pos%2 == 0 {
+			mask = b
+		} else if b != key[pos/2]&mask {
+			return true
+		}
+		pos++
+	}
+
+	k := append(prefix, node.key...)
+	if pos%2 == 0 && node.vPack != nil && node.vPack.Size() > 0 {
+		if !s.emit(k, node.vPack) {
+			return false
+		}
+	}
+
+	if pos/2 >= len(key) {
+		return true
+	}
+	return s.ternaryChunk(node.next, key, pos, mask, k)
+}
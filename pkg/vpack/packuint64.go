@@ -4,6 +4,8 @@ package vpack
 import (
 	"errors"
 	"math"
+	"math/bits"
+	"sort"
 )
 
 type PackUint64 uint64
@@ -27,6 +29,20 @@ func NewValuePack(tag uint32, capacity uint32) *VPack {
 	return &VPack{tag: tag, data: make([]PackUint64, 0, capacity)}
 }
 
+// NewValuePackFrom 使用已打包的数据构造VPack, data 不会被拷贝
+func NewValuePackFrom(tag uint32, data []PackUint64) *VPack {
+	return &VPack{tag: tag, data: data}
+}
+
+func (vp VPack) Tag() uint32 {
+	return vp.tag
+}
+
+// Data 返回内部的打包数据, 不允许修改
+func (vp VPack) Data() []PackUint64 {
+	return vp.data
+}
+
 func (vp VPack) Size() int {
 	return len(vp.data)
 }
@@ -79,6 +95,45 @@ func (vp *VPack) Add(value uint64) {
 	}
 }
 
+// Contains 判断value是否存在
+func (vp *VPack) Contains(value uint64) bool {
+	pv := Pack(value)
+
+	loc := vp.location(pv)
+	if loc < 0 {
+		return false
+	}
+
+	return vp.data[loc].bitmap()&pv.bitmap() != 0
+}
+
+// Remove 删除value, 返回value是否存在
+func (vp *VPack) Remove(value uint64) bool {
+	pv := Pack(value)
+
+	loc := vp.location(pv)
+	if loc < 0 || vp.data[loc].bitmap()&pv.bitmap() == 0 {
+		return false
+	}
+
+	vp.data[loc] = vp.data[loc] &^ PackUint64(pv.bitmap())
+	if vp.data[loc].bitmap() == 0 {
+		vp.data = append(vp.data[:loc], vp.data[loc+1:]...)
+	}
+
+	return true
+}
+
+// Count 返回value的个数
+func (vp *VPack) Count() int {
+	var count int
+	for _, v := range vp.data {
+		count += bits.OnesCount64(v.bitmap())
+	}
+
+	return count
+}
+
 func (vp *VPack) Unpack() []uint64 {
 	var vList []uint64
 
@@ -96,6 +151,34 @@ func (vp *VPack) Unpack() []uint64 {
 	return vList
 }
 
+// UnpackFrom 按升序返回不小于start的最多limit个value, limit <= 0 时不限数量;
+// 二分查找start所在的块, 不需要解包之前的value
+func (vp *VPack) UnpackFrom(start uint64, limit int) []uint64 {
+	var vList []uint64
+
+	loc := vp.location(Pack(start))
+	if loc < 0 {
+		loc = -loc - 1
+	}
+
+	for _, v := range vp.data[loc:] {
+		bitmap := v.bitmap()
+		if v.block() == start/ValueBitNum {
+			bitmap &^= 1<<(start%ValueBitNum) - 1
+		}
+
+		prefix := v.block() * ValueBitNum
+		for ; bitmap != 0; bitmap &= bitmap - 1 {
+			if limit > 0 && len(vList) >= limit {
+				return vList
+			}
+			vList = append(vList, prefix+uint64(bits.TrailingZeros64(bitmap)))
+		}
+	}
+
+	return vList
+}
+
 func (vp *VPack) location(v PackUint64) int {
 	if len(vp.data) == 0 {
 		return -1
@@ -210,3 +293,95 @@ func merge(s1, s2 []PackUint64) []PackUint64 {
 
 	return dest
 }
+
+// Union 求多个VPack的并集, 只排序合并一次, 适合大量小VPack的场景
+func Union(packs ...*VPack) *VPack {
+	var n int
+	var tag uint32
+	for _, vp := range packs {
+		if vp == nil {
+			continue
+		}
+		n += len(vp.data)
+		if tag == 0 {
+			tag = vp.tag
+		}
+	}
+
+	data := make([]PackUint64, 0, n)
+	for _, vp := range packs {
+		if vp != nil {
+			data = append(data, vp.data...)
+		}
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].block() < data[j].block()
+	})
+
+	// 相同block的bitmap合并
+	var j int
+	for i := 1; i < len(data); i++ {
+		if data[i].block() == data[j].block() {
+			data[j] |= data[i]
+		} else {
+			j++
+			data[j] = data[i]
+		}
+	}
+	if len(data) > 0 {
+		data = data[:j+1]
+	}
+
+	return &VPack{tag: tag, data: data}
+}
+
+// Intersect 求两个VPack的交集
+func Intersect(vp1, vp2 *VPack) *VPack {
+	newPack := NewValuePack(vp1.tag, 0)
+
+	var i, j int
+	for i < len(vp1.data) && j < len(vp2.data) {
+		b1 := vp1.data[i].block()
+		b2 := vp2.data[j].block()
+
+		switch {
+		case b1 < b2:
+			i++
+		case b1 > b2:
+			j++
+		default:
+			if bits := vp1.data[i].bitmap() & vp2.data[j].bitmap(); bits != 0 {
+				newPack.data = append(newPack.data, PackUint64(b1<<ValueBitNum|bits))
+			}
+			i++
+			j++
+		}
+	}
+
+	return newPack
+}
+
+// Difference 求vp1中不属于vp2的value
+func Difference(vp1, vp2 *VPack) *VPack {
+	newPack := NewValuePack(vp1.tag, uint32(len(vp1.data)))
+
+	var j int
+	for _, p1 := range vp1.data {
+		b1 := p1.block()
+		for j < len(vp2.data) && vp2.data[j].block() < b1 {
+			j++
+		}
+
+		bits := p1.bitmap()
+		if j < len(vp2.data) && vp2.data[j].block() == b1 {
+			bits &^= vp2.data[j].bitmap()
+		}
+
+		if bits != 0 {
+			newPack.data = append(newPack.data, PackUint64(b1<<ValueBitNum|bits))
+		}
+	}
+
+	return newPack
+}
@@ -45,3 +45,76 @@ func TestMerge(t *testing.T) {
 		return
 	}
 }
+
+func TestRemove(t *testing.T) {
+	p := NewValuePack(1, 0)
+	p.Add(1)
+	p.Add(33)
+	p.Add(34)
+
+	if p.Count() != 3 || !p.Contains(33) || p.Contains(2) {
+		t.Error("No Pass")
+	}
+
+	if !p.Remove(33) || p.Remove(33) || p.Remove(2) || p.Count() != 2 || p.Size() != 2 {
+		t.Error("No Pass")
+	}
+
+	if !p.Remove(34) || p.Size() != 1 || p.Contains(34) {
+		t.Error("No Pass")
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	p1 := NewValuePack(1, 0)
+	p2 := NewValuePack(1, 0)
+
+	for _, v := range []uint64{1, 2, 40, 100, 1000} {
+		p1.Add(v)
+	}
+	for _, v := range []uint64{2, 41, 100, 999, 5000} {
+		p2.Add(v)
+	}
+
+	ret := Intersect(p1, p2).Unpack()
+	if len(ret) != 2 || ret[0] != 2 || ret[1] != 100 {
+		t.Error("No Pass")
+	}
+
+	ret = Difference(p1, p2).Unpack()
+	if len(ret) != 3 || ret[0] != 1 || ret[1] != 40 || ret[2] != 1000 {
+		t.Error("No Pass")
+	}
+
+	ret = Union(p2, nil, p1, p1).Unpack()
+	if len(ret) != 8 || ret[0] != 1 || ret[3] != 41 || ret[7] != 5000 || Union().Size() != 0 {
+		t.Error("No Pass", ret)
+	}
+}
+
+func TestUnpackFrom(t *testing.T) {
+	p := NewValuePack(1, 0)
+	values := []uint64{0, 1, 31, 32, 40, 63, 100, 1000, 1001, 5000}
+	for _, v := range values {
+		p.Add(v)
+	}
+
+	for start := uint64(0); start <= 5001; start++ {
+		for _, limit := range []int{0, 1, 3} {
+			var expect []uint64
+			for _, v := range values {
+				if v >= start && (limit <= 0 || len(expect) < limit) {
+					expect = append(expect, v)
+				}
+			}
+
+			if ret := p.UnpackFrom(start, limit); fmt.Sprint(ret) != fmt.Sprint(expect) {
+				t.Error("No Pass", start, limit, ret)
+			}
+		}
+	}
+
+	if ret := NewValuePack(1, 0).UnpackFrom(0, 0); len(ret) != 0 {
+		t.Error("No Pass", ret)
+	}
+}